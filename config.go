@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/scaler"
+)
+
+// envPrefix is prepended to the upper-cased flag name to find the environment
+// variable that can be used instead of a flag, e.g.
+// BUILDKITE_GCP_SCALER_BUILDKITE_TOKEN for -buildkite-token.
+const envPrefix = "BUILDKITE_GCP_SCALER_"
+
+// setFlags records every flag that was given explicitly, either on the
+// command line or through the environment. Only these override the contents
+// of a configuration file.
+var setFlags = map[string]bool{}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// applyEnvironment sets any flag that wasn't given on the command line from
+// its environment variable.
+func applyEnvironment(fs *flag.FlagSet) error {
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || setFlags[f.Name] || len(f.Name) == 1 {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("Invalid value %q for %s: %v", value, envName(f.Name), setErr)
+			return
+		}
+		setFlags[f.Name] = true
+	})
+
+	return err
+}
+
+// loadConfig builds the scaler configuration. Without -config it comes
+// entirely from flags; otherwise the file is loaded and any flags that were
+// set explicitly are layered on top.
+func loadConfig() (*scaler.Config, error) {
+	cfg := &scaler.Config{}
+	if configPath != "" {
+		c, err := scaler.LoadConfigFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg = c
+	}
+
+	override := func(name string) bool {
+		return configPath == "" || setFlags[name]
+	}
+
+	if override("gcp-project") {
+		cfg.GCPProject = googleCloudProject
+	}
+	if override("buildkite-token") {
+		cfg.BuildkiteToken = buildkiteToken
+	}
+	if override("buildkite-api-token") {
+		cfg.BuildkiteAPIToken = buildkiteAPIToken
+	}
+
+	if override("launch-concurrency") {
+		cfg.LaunchConcurrency = launchConcurrency
+	}
+
+	if override("unhealthy-after-failures") {
+		cfg.UnhealthyAfterFailures = unhealthyAfterFailures
+	}
+	if override("stale-after-intervals") {
+		cfg.StaleAfterIntervals = staleAfterIntervals
+	}
+
+	if override("scaler-id") {
+		cfg.ScalerID = scalerID
+	}
+
+	if override("dynamic-agent-tokens") {
+		cfg.DynamicAgentTokens = dynamicAgentTokens
+	}
+	if override("agent-token-ttl") {
+		cfg.AgentTokenTTL = agentTokenTTL
+	}
+	if override("agent-token-metadata-key") {
+		cfg.AgentTokenMetadataKey = agentTokenMetadataKey
+	}
+
+	if override("history-file") {
+		cfg.HistoryFile = historyFile
+	}
+
+	if override("dry-run") {
+		cfg.DryRun = dryRun
+	}
+
+	if override("interval") && interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("Parsing duration failed: %v", err)
+		}
+
+		cfg.PollInterval = &d
+	}
+
+	switch {
+	case len(queues) > 0:
+		queueConfigs, err := queues.queueConfigs()
+		if err != nil {
+			return nil, err
+		}
+		cfg.Queues = queueConfigs
+	case len(cfg.Queues) == 0:
+		cfg.Queues = []*scaler.QueueConfig{defaultQueueConfig()}
+	default:
+		for _, qc := range cfg.Queues {
+			applyQueueFlags(qc)
+		}
+	}
+
+	return cfg, nil
+}
+
+// applyQueueFlags overrides the settings of a queue loaded from a
+// configuration file with any queue flags that were set explicitly.
+func applyQueueFlags(qc *scaler.QueueConfig) {
+	if setFlags["buildkite-queue"] {
+		qc.BuildkiteQueue = buildkiteQueue
+	}
+	if setFlags["gcp-zone"] {
+		qc.GCPZone = googleCloudZone
+	}
+	if setFlags["gcp-zones"] {
+		qc.Zones = parseZones(googleCloudZones, ",")
+	}
+	if setFlags["gcp-region"] {
+		qc.GCPRegion = googleCloudRegion
+	}
+	if setFlags["instance-group"] {
+		qc.InstanceGroupName = googleCloudInstanceGroup
+	}
+	if setFlags["instance-group-type"] {
+		qc.InstanceGroupType = googleCloudInstanceGroupType
+	}
+	if setFlags["instance-template"] {
+		qc.InstanceGroupTemplate = googleCloudTemplateName
+	}
+	if setFlags["spot-template"] {
+		qc.SpotInstanceTemplate = googleCloudSpotTemplateName
+	}
+	if setFlags["spot-ratio"] {
+		qc.SpotRatio = spotRatio
+	}
+	if setFlags["min-instances"] {
+		qc.MinInstances = minInstances
+	}
+	if setFlags["max-instances"] {
+		qc.MaxInstances = maxInstances
+	}
+	if setFlags["agents-per-instance"] {
+		qc.AgentsPerInstance = agentsPerInstance
+	}
+	if setFlags["target-utilization"] {
+		qc.TargetUtilization = targetUtilization
+	}
+	if setFlags["max-launch-per-pass"] {
+		qc.MaxLaunchPerPass = maxLaunchPerPass
+	}
+	if setFlags["idle-timeout"] {
+		qc.IdleTimeout = idleTimeout
+	}
+	if setFlags["scale-in-cooldown"] {
+		qc.ScaleInCooldown = scaleInCooldown
+	}
+	if setFlags["scale-out-cooldown"] {
+		qc.ScaleOutCooldown = scaleOutCooldown
+	}
+	if setFlags["scale-in-hysteresis"] {
+		qc.ScaleInHysteresis = scaleInHysteresis
+	}
+	if setFlags["provisioning-timeout"] {
+		qc.ProvisioningTimeout = provisioningTimeout
+	}
+	if setFlags["boot-timeout"] {
+		qc.BootTimeout = bootTimeout
+	}
+	if setFlags["placement"] {
+		qc.Placement = placement
+	}
+	if setFlags["zone-failure-cooldown"] {
+		qc.ZoneFailureCooldown = zoneFailureCooldown
+	}
+}
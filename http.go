@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/scaler"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// startHTTPServer serves Prometheus metrics and health checks for s on addr
+// in the background. It returns once the listener is bound so that bad
+// addresses fail fast.
+func startHTTPServer(addr string, s scaler.Scaler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthHandler(s, false))
+	mux.Handle("/readyz", healthHandler(s, true))
+
+	logger.Info("Serving metrics and health checks", "addr", l.Addr().String())
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			logger.Error("HTTP server failed", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// healthHandler reports the scaler's health as JSON. When checkReady is set
+// it responds with 503 Service Unavailable if the scaler isn't ready.
+func healthHandler(s scaler.Scaler, checkReady bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := s.Health()
+
+		w.Header().Set("Content-Type", "application/json")
+		if checkReady && !health.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		if err := json.NewEncoder(w).Encode(health); err != nil {
+			logger.Error("Writing health response failed", "error", err)
+		}
+	})
+}
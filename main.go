@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/endocrimes/buildkite-gcp-scaler/scaler"
@@ -12,15 +14,52 @@ import (
 )
 
 var (
-	buildkiteToken string
-	buildkiteQueue string
-
-	googleCloudProject       string
-	googleCloudZone          string
-	googleCloudInstanceGroup string
-	googleCloudTemplateName  string
-
-	interval string
+	buildkiteToken    string
+	buildkiteAPIToken string
+	buildkiteQueue    string
+
+	googleCloudProject           string
+	googleCloudZone              string
+	googleCloudZones             string
+	googleCloudRegion            string
+	googleCloudInstanceGroup     string
+	googleCloudInstanceGroupType string
+	googleCloudTemplateName      string
+	googleCloudSpotTemplateName  string
+	spotRatio                    float64
+
+	minInstances     int64
+	maxInstances     int64
+	maxLaunchPerPass int64
+
+	agentsPerInstance int64
+	targetUtilization int64
+
+	launchConcurrency int
+
+	httpAddr               string
+	scalerID               string
+	dynamicAgentTokens     bool
+	agentTokenTTL          time.Duration
+	agentTokenMetadataKey  string
+	statusFormat           string
+	dryRun                 bool
+	unhealthyAfterFailures int
+	staleAfterIntervals    int
+
+	queues queueBindings
+
+	configPath          string
+	historyFile         string
+	interval            string
+	idleTimeout         time.Duration
+	scaleInCooldown     time.Duration
+	scaleOutCooldown    time.Duration
+	scaleInHysteresis   int64
+	provisioningTimeout time.Duration
+	bootTimeout         time.Duration
+	placement           string
+	zoneFailureCooldown time.Duration
 
 	logger hclog.Logger
 )
@@ -35,28 +74,110 @@ func (cmd *runCommand) ShortHelp() string { return runHelp }
 func (cmd *runCommand) LongHelp() string  { return runHelp }
 func (cmd *runCommand) Hidden() bool      { return false }
 
-func (cmd *runCommand) Register(fs *flag.FlagSet) {}
+func (cmd *runCommand) Register(fs *flag.FlagSet) {
+	fs.IntVar(&launchConcurrency, "launch-concurrency", scaler.DefaultLaunchConcurrency, "Number of instances per queue to launch in parallel")
+	fs.StringVar(&httpAddr, "http-addr", "", "Address to serve Prometheus metrics and health checks on, e.g. :9090")
+	fs.BoolVar(&dryRun, "dry-run", false, "Log the instances that would be launched or deleted without changing anything")
+	fs.IntVar(&unhealthyAfterFailures, "unhealthy-after-failures", scaler.DefaultUnhealthyAfterFailures, "Consecutive failed passes after which /readyz fails")
+	fs.IntVar(&staleAfterIntervals, "stale-after-intervals", scaler.DefaultStaleAfterIntervals, "Poll intervals without a completed pass after which /readyz fails")
+	fs.StringVar(&scalerID, "scaler-id", "", "Identifies this scaler in the labels of the instances it launches (defaults to the hostname)")
+	fs.BoolVar(&dynamicAgentTokens, "dynamic-agent-tokens", false, "Create an agent token for every instance with the GraphQL API, requires -buildkite-api-token")
+	fs.DurationVar(&agentTokenTTL, "agent-token-ttl", scaler.DefaultAgentTokenTTL, "How long an instance's agent token remains valid")
+	fs.StringVar(&agentTokenMetadataKey, "agent-token-metadata-key", scaler.DefaultAgentTokenMetadataKey, "Instance metadata key the agent token is passed in")
+	fs.StringVar(&historyFile, "history-file", "", "File to persist the demand history used by queue forecasts in")
+}
 
 func (cmd *runCommand) Run(ctx context.Context, args []string) error {
-	cfg := &scaler.Config{
-		GCPProject:            googleCloudProject,
-		GCPZone:               googleCloudZone,
-		InstanceGroupName:     googleCloudInstanceGroup,
-		InstanceGroupTemplate: googleCloudTemplateName,
-		BuildkiteQueue:        buildkiteQueue,
-		BuildkiteToken:        buildkiteToken,
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
 	}
 
-	if interval != "" {
-		d, err := time.ParseDuration(interval)
-		if err != nil {
-			return fmt.Errorf("Parsing duration failed: %v", err)
+	s := scaler.NewAutoscaler(cfg, logger)
+
+	if httpAddr != "" {
+		if err := startHTTPServer(httpAddr, s); err != nil {
+			return err
 		}
+	}
+
+	return s.Run(ctx)
+}
+
+type validateCommand struct{}
+
+const validateHelp = `Validate the configuration without running the autoscaler.`
+
+func (cmd *validateCommand) Name() string      { return "validate" }
+func (cmd *validateCommand) Args() string      { return "[config-file]" }
+func (cmd *validateCommand) ShortHelp() string { return validateHelp }
+func (cmd *validateCommand) LongHelp() string  { return validateHelp }
+func (cmd *validateCommand) Hidden() bool      { return false }
+
+func (cmd *validateCommand) Register(fs *flag.FlagSet) {}
+
+func (cmd *validateCommand) Run(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		configPath = args[0]
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
+	}
+
+	fmt.Println("Configuration is valid")
+	return nil
+}
+
+type statusCommand struct{}
+
+const statusHelp = `Show the jobs and instances of every queue and what the scaler would do.`
+
+func (cmd *statusCommand) Name() string      { return "status" }
+func (cmd *statusCommand) Args() string      { return "" }
+func (cmd *statusCommand) ShortHelp() string { return statusHelp }
+func (cmd *statusCommand) LongHelp() string  { return statusHelp }
+func (cmd *statusCommand) Hidden() bool      { return false }
+
+func (cmd *statusCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&statusFormat, "format", "table", "Output format, table or json")
+}
+
+func (cmd *statusCommand) Run(ctx context.Context, args []string) error {
+	if statusFormat != "table" && statusFormat != "json" {
+		return fmt.Errorf("Unknown format %q", statusFormat)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
+	}
 
-		cfg.PollInterval = &d
+	statuses, err := scaler.NewAutoscaler(cfg, logger).Status(ctx)
+	if err != nil {
+		return err
 	}
 
-	return scaler.NewAutoscaler(cfg, logger).Run(ctx)
+	if statusFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+	}
+
+	return printStatus(os.Stdout, statuses)
 }
 
 func main() {
@@ -70,15 +191,40 @@ func main() {
 	)
 	p.FlagSet = flag.NewFlagSet("global", flag.ExitOnError)
 	p.FlagSet.BoolVar(&debug, "d", false, "enable debug logging")
+	p.FlagSet.StringVar(&configPath, "config", "", "Path to a YAML configuration file")
 	p.FlagSet.StringVar(&buildkiteToken, "buildkite-token", "", "Buildkite API Token")
+	p.FlagSet.StringVar(&buildkiteAPIToken, "buildkite-api-token", "", "Buildkite REST API Token, required for scale-in")
 	p.FlagSet.StringVar(&buildkiteQueue, "buildkite-queue", "default", "Buildkite Queue Name")
 	p.FlagSet.StringVar(&googleCloudInstanceGroup, "instance-group", "", "Google Cloud Instance Group")
+	p.FlagSet.StringVar(&googleCloudInstanceGroupType, "instance-group-type", scaler.GroupTypeUnmanaged, "Google Cloud Instance Group type, unmanaged or managed")
 	p.FlagSet.StringVar(&googleCloudTemplateName, "instance-template", "", "Google Cloud Instance Template")
+	p.FlagSet.StringVar(&googleCloudSpotTemplateName, "spot-template", "", "Google Cloud Instance Template for Spot VMs, falling back to -instance-template")
+	p.FlagSet.Float64Var(&spotRatio, "spot-ratio", scaler.DefaultSpotRatio, "Fraction of instances to launch from -spot-template")
+	p.FlagSet.Int64Var(&minInstances, "min-instances", 0, "Minimum number of instances to keep running")
+	p.FlagSet.Int64Var(&maxInstances, "max-instances", 0, "Maximum number of instances in the group (0 for unlimited)")
+	p.FlagSet.Int64Var(&agentsPerInstance, "agents-per-instance", scaler.DefaultAgentsPerInstance, "Number of agents each instance runs")
+	p.FlagSet.Int64Var(&targetUtilization, "target-utilization", scaler.DefaultTargetUtilization, "Percentage of agents that should be busy at the desired instance count")
+	p.FlagSet.Int64Var(&maxLaunchPerPass, "max-launch-per-pass", 0, "Maximum number of instances to launch in a single pass (0 for unlimited)")
+	p.FlagSet.Var(&queues, "queue", "Bind a queue to an instance group, as name=...,instance-group=...,instance-template=...[,gcp-zone=...] (repeatable)")
 	p.FlagSet.StringVar(&googleCloudProject, "gcp-project", "", "Google Cloud Project")
 	p.FlagSet.StringVar(&googleCloudZone, "gcp-zone", "", "Google Cloud Zone")
+	p.FlagSet.StringVar(&googleCloudZones, "gcp-zones", "", "Comma separated Google Cloud Zones to spread an unmanaged instance group across")
+	p.FlagSet.StringVar(&googleCloudRegion, "gcp-region", "", "Google Cloud Region, for regional managed instance groups")
 	p.FlagSet.StringVar(&interval, "interval", "", "How frequently the scaler should run")
+	p.FlagSet.DurationVar(&idleTimeout, "idle-timeout", scaler.DefaultIdleTimeout, "How long an agent must be idle before its instance is removed")
+	p.FlagSet.DurationVar(&scaleInCooldown, "scale-in-cooldown", scaler.DefaultScaleInCooldown, "Minimum time between a scaling action and the next scale-in")
+	p.FlagSet.DurationVar(&provisioningTimeout, "provisioning-timeout", scaler.DefaultProvisioningTimeout, "How long an instance may take to start before it is deleted as stuck (0 to disable)")
+	p.FlagSet.DurationVar(&bootTimeout, "boot-timeout", scaler.DefaultBootTimeout, "How long a running instance may go without a connected agent before it is considered lost")
+	p.FlagSet.DurationVar(&scaleOutCooldown, "scale-out-cooldown", 0, "Minimum time between launches")
+	p.FlagSet.Int64Var(&scaleInHysteresis, "scale-in-hysteresis", 0, "Number of surplus instances tolerated before scaling in")
+	p.FlagSet.StringVar(&placement, "placement", scaler.PlacementRoundRobin, "How launches are spread across -gcp-zones: round-robin, least-loaded or weighted")
+	p.FlagSet.DurationVar(&zoneFailureCooldown, "zone-failure-cooldown", scaler.DefaultZoneFailureCooldown, "How long to skip a zone after it runs out of capacity")
 
 	p.Before = func(ctx context.Context) error {
+		if err := applyEnvironment(p.FlagSet); err != nil {
+			return err
+		}
+
 		logLevel := "INFO"
 		if debug {
 			logLevel = "DEBUG"
@@ -94,6 +240,8 @@ func main() {
 	// Add our commands.
 	p.Commands = []cli.Command{
 		&runCommand{},
+		&validateCommand{},
+		&statusCommand{},
 	}
 
 	// Run our program.
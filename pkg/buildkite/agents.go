@@ -0,0 +1,158 @@
+package buildkite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// Agent is an agent registered with a Buildkite organization, as returned by
+// the REST API.
+type Agent struct {
+	ID                string     `json:"id"`
+	Name              string     `json:"name"`
+	Hostname          string     `json:"hostname"`
+	ConnectionState   string     `json:"connection_state"`
+	MetaData          []string   `json:"meta_data"`
+	CreatedAt         *time.Time `json:"created_at"`
+	LastJobFinishedAt *time.Time `json:"last_job_finished_at"`
+	Job               *struct {
+		ID    string `json:"id"`
+		State string `json:"state"`
+	} `json:"job"`
+}
+
+// Stopped reports whether the agent has disconnected and isn't running a job,
+// so that its instance can be deleted.
+func (a *Agent) Stopped() bool {
+	return !a.Connected() && !a.Busy()
+}
+
+// Connected reports whether the agent is currently connected to Buildkite.
+func (a *Agent) Connected() bool {
+	return a.ConnectionState == "connected"
+}
+
+// Busy reports whether the agent is currently running a job.
+func (a *Agent) Busy() bool {
+	return a.Job != nil
+}
+
+// IdleSince returns the time at which the agent last became idle, either
+// because it finished a job or because it registered.
+func (a *Agent) IdleSince() time.Time {
+	if a.LastJobFinishedAt != nil {
+		return *a.LastJobFinishedAt
+	}
+	if a.CreatedAt != nil {
+		return *a.CreatedAt
+	}
+	return time.Time{}
+}
+
+var nextLinkRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// ListAgents returns every connected agent in the given organization. It
+// requires an API token with the read_agents scope.
+func (c *Client) ListAgents(ctx context.Context, orgSlug string) ([]*Agent, error) {
+	if c.APIToken == "" {
+		return nil, fmt.Errorf("Listing agents requires a Buildkite API token")
+	}
+
+	endpoint, err := url.Parse(c.APIEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.Path += fmt.Sprintf("/organizations/%s/agents", orgSlug)
+	endpoint.RawQuery = "per_page=100"
+
+	c.Logger.Debug("Listing agents", "org", orgSlug)
+
+	t := time.Now()
+	var agents []*Agent
+	next := endpoint.String()
+	for next != "" {
+		var page []*Agent
+		next, err = c.getAgentsPage(ctx, next, &page)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, page...)
+	}
+	d := time.Now().Sub(t)
+
+	c.Logger.Debug("Retrieved agents", "count", len(agents), "duration", d)
+	return agents, nil
+}
+
+func (c *Client) getAgentsPage(ctx context.Context, endpoint string, into *[]*Agent) (string, error) {
+	res, err := c.do(ctx, "agents", "GET", endpoint, fmt.Sprintf("Bearer %s", c.APIToken), nil, true)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	next := ""
+	if m := nextLinkRegexp.FindStringSubmatch(res.Header.Get("Link")); m != nil {
+		next = m[1]
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(into); err != nil {
+		return "", fmt.Errorf("Decoding agents failed: %v", err)
+	}
+	return next, nil
+}
+
+// GetAgent returns a single agent of the organization. It requires an API
+// token with the read_agents scope.
+func (c *Client) GetAgent(ctx context.Context, orgSlug, id string) (*Agent, error) {
+	endpoint, err := c.agentURL(orgSlug, id, "")
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.do(ctx, "agents", "GET", endpoint, fmt.Sprintf("Bearer %s", c.APIToken), nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var agent Agent
+	if err := json.NewDecoder(res.Body).Decode(&agent); err != nil {
+		return nil, fmt.Errorf("Decoding agent failed: %v", err)
+	}
+	return &agent, nil
+}
+
+// StopAgent asks an agent to disconnect once it finishes any job it is
+// running. It requires an API token with the write_agents scope.
+func (c *Client) StopAgent(ctx context.Context, orgSlug, id string) error {
+	endpoint, err := c.agentURL(orgSlug, id, "/stop")
+	if err != nil {
+		return err
+	}
+
+	c.Logger.Debug("Stopping agent", "org", orgSlug, "id", id)
+
+	res, err := c.do(ctx, "stop_agent", "PUT", endpoint, fmt.Sprintf("Bearer %s", c.APIToken), []byte(`{"force":false}`), true)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (c *Client) agentURL(orgSlug, id, suffix string) (string, error) {
+	if c.APIToken == "" {
+		return "", fmt.Errorf("Managing agents requires a Buildkite API token")
+	}
+
+	endpoint, err := url.Parse(c.APIEndpoint)
+	if err != nil {
+		return "", err
+	}
+	endpoint.Path += fmt.Sprintf("/organizations/%s/agents/%s%s", orgSlug, id, suffix)
+	return endpoint.String(), nil
+}
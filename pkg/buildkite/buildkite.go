@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	cleanhttp "github.com/hashicorp/go-cleanhttp"
@@ -15,20 +16,35 @@ import (
 )
 
 type Client struct {
-	Endpoint   string
-	AgentToken string
-	UserAgent  string
-	HTTPClient *http.Client
-	Logger     hclog.Logger
+	Endpoint        string
+	APIEndpoint     string
+	GraphQLEndpoint string
+	AgentToken      string
+	APIToken        string
+	UserAgent       string
+	HTTPClient      *http.Client
+	Logger          hclog.Logger
+
+	// MaxRetries is the number of times failed requests are retried. It
+	// defaults to DefaultMaxRetries; a negative value disables retries.
+	MaxRetries int
+
+	// orgIDs caches the GraphQL IDs of organizations by slug.
+	orgIDs   map[string]string
+	orgIDsMu sync.Mutex
 }
 
-func NewClient(agentToken string, logger hclog.Logger) *Client {
+func NewClient(agentToken, apiToken string, logger hclog.Logger) *Client {
 	return &Client{
-		Endpoint:   "https://agent.buildkite.com/v3",
-		UserAgent:  "buildkite-gce-scaler/0.1",
-		AgentToken: agentToken,
-		HTTPClient: cleanhttp.DefaultClient(),
-		Logger:     logger.Named("bkapi"),
+		Endpoint:        "https://agent.buildkite.com/v3",
+		APIEndpoint:     "https://api.buildkite.com/v2",
+		GraphQLEndpoint: "https://graphql.buildkite.com/v1",
+		UserAgent:       "buildkite-gce-scaler/0.1",
+		AgentToken:      agentToken,
+		APIToken:        apiToken,
+		HTTPClient:      cleanhttp.DefaultClient(),
+		Logger:          logger.Named("bkapi"),
+		orgIDs:          make(map[string]string),
 	}
 }
 
@@ -37,16 +53,33 @@ type AgentMetrics struct {
 	Queue         string
 	ScheduledJobs int64
 	RunningJobs   int64
+	// WaitingJobs are blocked on other jobs or concurrency limits, and can't
+	// be run yet.
+	WaitingJobs int64
+
+	// IdleAgents, BusyAgents and TotalAgents count the connected agents on
+	// the queue, wherever they run.
+	IdleAgents  int64
+	BusyAgents  int64
+	TotalAgents int64
 }
 
 type metricsQueryResponse struct {
 	Organization struct {
 		Slug string `json:"slug"`
 	} `json:"organization"`
+	Agents struct {
+		Queues map[string]struct {
+			Idle  int64 `json:"idle"`
+			Busy  int64 `json:"busy"`
+			Total int64 `json:"total"`
+		} `json:"queues"`
+	} `json:"agents"`
 	Jobs struct {
 		Queues map[string]struct {
 			Scheduled int64 `json:"scheduled"`
 			Running   int64 `json:"running"`
+			Waiting   int64 `json:"waiting"`
 		} `json:"queues"`
 	} `json:"jobs"`
 }
@@ -56,16 +89,25 @@ func (m *metricsQueryResponse) agentMetrics(queue string) *AgentMetrics {
 	metrics.OrgSlug = m.Organization.Slug
 	metrics.Queue = queue
 
-	if queue, exists := m.Jobs.Queues[queue]; exists {
-		metrics.ScheduledJobs = queue.Scheduled
-		metrics.RunningJobs = queue.Running
+	if jobs, exists := m.Jobs.Queues[queue]; exists {
+		metrics.ScheduledJobs = jobs.Scheduled
+		metrics.RunningJobs = jobs.Running
+		metrics.WaitingJobs = jobs.Waiting
+	}
+	if agents, exists := m.Agents.Queues[queue]; exists {
+		metrics.IdleAgents = agents.Idle
+		metrics.BusyAgents = agents.Busy
+		metrics.TotalAgents = agents.Total
 	}
 
 	return &metrics
 }
 
-func (c *Client) GetAgentMetrics(ctx context.Context, queue string) (*AgentMetrics, error) {
-	c.Logger.Debug("Collecting agent metrics", "queue", queue)
+// GetAgentMetricsByQueue returns the metrics of every queue in the
+// organization that has jobs or agents from a single request, keyed by queue
+// name.
+func (c *Client) GetAgentMetricsByQueue(ctx context.Context) (map[string]*AgentMetrics, error) {
+	c.Logger.Debug("Collecting agent metrics for all queues")
 
 	t := time.Now()
 	resp, err := c.getMetrics(ctx)
@@ -74,12 +116,21 @@ func (c *Client) GetAgentMetrics(ctx context.Context, queue string) (*AgentMetri
 	}
 	d := time.Now().Sub(t)
 
-	metrics := resp.agentMetrics(queue)
+	metrics := make(map[string]*AgentMetrics, len(resp.Jobs.Queues))
+	for queue := range resp.Jobs.Queues {
+		metrics[queue] = resp.agentMetrics(queue)
+	}
+	for queue := range resp.Agents.Queues {
+		metrics[queue] = resp.agentMetrics(queue)
+	}
 
-	c.Logger.Debug("Retreived agent metrics", "scheduled", metrics.ScheduledJobs, "running", metrics.RunningJobs, "duration", d)
+	c.Logger.Debug("Retreived agent metrics", "queues", len(metrics), "duration", d)
 	return metrics, nil
 }
 
+// getMetrics fetches the organization's job metrics. A response without an
+// organization is treated as an error rather than as an organization without
+// jobs.
 func (c *Client) getMetrics(ctx context.Context) (*metricsQueryResponse, error) {
 	endpoint, err := url.Parse(c.Endpoint)
 	if err != nil {
@@ -87,20 +138,19 @@ func (c *Client) getMetrics(ctx context.Context) (*metricsQueryResponse, error)
 	}
 	endpoint.Path += "/metrics"
 
-	req, err := http.NewRequest("GET", endpoint.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("User-Agent", c.UserAgent)
-	req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.AgentToken))
-
-	res, err := c.HTTPClient.Do(req.WithContext(ctx))
+	res, err := c.do(ctx, "metrics", "GET", endpoint.String(), fmt.Sprintf("Token %s", c.AgentToken), nil, true)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
 	var response metricsQueryResponse
-	return &response, json.NewDecoder(res.Body).Decode(&response)
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("Decoding metrics failed: %v", err)
+	}
+	if response.Organization.Slug == "" {
+		return nil, fmt.Errorf("Metrics response has no organization")
+	}
+
+	return &response, nil
 }
@@ -0,0 +1,87 @@
+package buildkite
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// APIError is returned when Buildkite responds to a request with a status
+// outside 2xx.
+type APIError struct {
+	Endpoint   string
+	StatusCode int
+	Status     string
+	// RetryAfter is how long Buildkite asked us to wait before retrying, if
+	// it did.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Buildkite %s request failed: %s", e.Endpoint, e.Status)
+}
+
+// Temporary reports whether the request may succeed if it's retried.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// IsUnauthorized reports whether err, or any error wrapped by it, was caused
+// by Buildkite rejecting the token.
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, func(code int) bool {
+		return code == http.StatusUnauthorized || code == http.StatusForbidden
+	})
+}
+
+// IsNotFound reports whether err, or any error wrapped by it, was caused by
+// Buildkite not finding the requested resource.
+func IsNotFound(err error) bool {
+	return hasStatus(err, func(code int) bool {
+		return code == http.StatusNotFound
+	})
+}
+
+// IsRateLimited reports whether err, or any error wrapped by it, was caused
+// by Buildkite rate limiting the client.
+func IsRateLimited(err error) bool {
+	return hasStatus(err, func(code int) bool {
+		return code == http.StatusTooManyRequests
+	})
+}
+
+// IsServerError reports whether err, or any error wrapped by it, was caused
+// by an error in Buildkite.
+func IsServerError(err error) bool {
+	return hasStatus(err, func(code int) bool {
+		return code >= 500
+	})
+}
+
+func hasStatus(err error, match func(int) bool) bool {
+	found := false
+	errwrap.Walk(err, func(err error) {
+		if e, ok := err.(*APIError); ok && match(e.StatusCode) {
+			found = true
+		}
+	})
+	return found
+}
+
+// errorKind classifies err for metrics.
+func errorKind(err error) string {
+	switch {
+	case IsUnauthorized(err):
+		return "unauthorized"
+	case IsRateLimited(err):
+		return "rate_limited"
+	case IsServerError(err):
+		return "server_error"
+	}
+	if _, ok := err.(*APIError); ok {
+		return "client_error"
+	}
+	return "transport"
+}
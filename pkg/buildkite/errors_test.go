@@ -0,0 +1,61 @@
+package buildkite
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/errwrap"
+)
+
+func TestErrorClassification(t *testing.T) {
+	cases := []struct {
+		status int
+
+		unauthorized bool
+		notFound     bool
+		rateLimited  bool
+		serverError  bool
+		temporary    bool
+		kind         string
+	}{
+		{status: 400, kind: "client_error"},
+		{status: 401, unauthorized: true, kind: "unauthorized"},
+		{status: 403, unauthorized: true, kind: "unauthorized"},
+		{status: 404, notFound: true, kind: "client_error"},
+		{status: 429, rateLimited: true, temporary: true, kind: "rate_limited"},
+		{status: 500, serverError: true, temporary: true, kind: "server_error"},
+		{status: 503, serverError: true, temporary: true, kind: "server_error"},
+	}
+
+	for _, tc := range cases {
+		apiErr := &APIError{Endpoint: "test", StatusCode: tc.status}
+		if got := apiErr.Temporary(); got != tc.temporary {
+			t.Errorf("%d: Temporary() = %v, expected %v", tc.status, got, tc.temporary)
+		}
+
+		// Wrapped errors are classified by the APIError they wrap.
+		wrapped := errwrap.Wrapf("Listing failed: {{err}}", apiErr)
+		for _, err := range []error{apiErr, wrapped} {
+			if got := IsUnauthorized(err); got != tc.unauthorized {
+				t.Errorf("%d: IsUnauthorized(%v) = %v, expected %v", tc.status, err, got, tc.unauthorized)
+			}
+			if got := IsNotFound(err); got != tc.notFound {
+				t.Errorf("%d: IsNotFound(%v) = %v, expected %v", tc.status, err, got, tc.notFound)
+			}
+			if got := IsRateLimited(err); got != tc.rateLimited {
+				t.Errorf("%d: IsRateLimited(%v) = %v, expected %v", tc.status, err, got, tc.rateLimited)
+			}
+			if got := IsServerError(err); got != tc.serverError {
+				t.Errorf("%d: IsServerError(%v) = %v, expected %v", tc.status, err, got, tc.serverError)
+			}
+		}
+
+		if got := errorKind(apiErr); got != tc.kind {
+			t.Errorf("%d: errorKind() = %q, expected %q", tc.status, got, tc.kind)
+		}
+	}
+
+	if got := errorKind(errors.New("connection refused")); got != "transport" {
+		t.Errorf("errorKind() of a transport error = %q, expected %q", got, "transport")
+	}
+}
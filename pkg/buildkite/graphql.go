@@ -0,0 +1,276 @@
+package buildkite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AgentToken is an agent registration token, as returned by the GraphQL
+// API. Token is only set when the token is created.
+type AgentToken struct {
+	ID          string     `json:"id"`
+	Description string     `json:"description"`
+	Token       string     `json:"-"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	RevokedAt   *time.Time `json:"revokedAt"`
+}
+
+type graphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+type graphQLResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// graphQL runs a query or mutation against the GraphQL API and decodes its
+// data into into. It requires an API token with GraphQL access.
+func (c *Client) graphQL(ctx context.Context, query string, variables map[string]interface{}, into interface{}) error {
+	if c.APIToken == "" {
+		return fmt.Errorf("The GraphQL API requires a Buildkite API token")
+	}
+
+	body, err := json.Marshal(&graphQLRequest{Query: query, Variables: variables})
+	if err != nil {
+		return err
+	}
+
+	// Retrying a mutation could apply it twice, e.g. creating two tokens.
+	mutation := strings.HasPrefix(strings.TrimSpace(query), "mutation")
+	res, err := c.do(ctx, "graphql", "POST", c.GraphQLEndpoint, fmt.Sprintf("Bearer %s", c.APIToken), body, !mutation)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var response graphQLResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return fmt.Errorf("Decoding GraphQL response failed: %v", err)
+	}
+
+	if len(response.Errors) > 0 {
+		messages := make([]string, 0, len(response.Errors))
+		for _, e := range response.Errors {
+			messages = append(messages, e.Message)
+		}
+		return fmt.Errorf("GraphQL request failed: %s", strings.Join(messages, "; "))
+	}
+
+	return json.Unmarshal(response.Data, into)
+}
+
+// organizationID returns the GraphQL ID of the organization, which mutations
+// require instead of its slug.
+func (c *Client) organizationID(ctx context.Context, orgSlug string) (string, error) {
+	c.orgIDsMu.Lock()
+	id, ok := c.orgIDs[orgSlug]
+	c.orgIDsMu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	var data struct {
+		Organization *struct {
+			ID string `json:"id"`
+		} `json:"organization"`
+	}
+	err := c.graphQL(ctx, `query($slug: ID!) { organization(slug: $slug) { id } }`,
+		map[string]interface{}{"slug": orgSlug}, &data)
+	if err != nil {
+		return "", err
+	}
+	if data.Organization == nil {
+		return "", fmt.Errorf("Organization %s not found", orgSlug)
+	}
+
+	c.orgIDsMu.Lock()
+	c.orgIDs[orgSlug] = data.Organization.ID
+	c.orgIDsMu.Unlock()
+
+	return data.Organization.ID, nil
+}
+
+// CreateAgentToken creates a new agent registration token in the
+// organization.
+func (c *Client) CreateAgentToken(ctx context.Context, orgSlug, description string) (*AgentToken, error) {
+	orgID, err := c.organizationID(ctx, orgSlug)
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		AgentTokenCreate struct {
+			TokenValue     string `json:"tokenValue"`
+			AgentTokenEdge struct {
+				Node *AgentToken `json:"node"`
+			} `json:"agentTokenEdge"`
+		} `json:"agentTokenCreate"`
+	}
+	err = c.graphQL(ctx, `mutation($org: ID!, $description: String!) {
+  agentTokenCreate(input: {organizationID: $org, description: $description}) {
+    tokenValue
+    agentTokenEdge { node { id description createdAt revokedAt } }
+  }
+}`, map[string]interface{}{"org": orgID, "description": description}, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	token := data.AgentTokenCreate.AgentTokenEdge.Node
+	if token == nil || data.AgentTokenCreate.TokenValue == "" {
+		return nil, fmt.Errorf("Creating agent token returned no token")
+	}
+	token.Token = data.AgentTokenCreate.TokenValue
+
+	c.Logger.Debug("Created agent token", "id", token.ID, "description", description)
+	return token, nil
+}
+
+// RevokeAgentToken revokes an agent registration token. Agents that already
+// registered with it keep running.
+func (c *Client) RevokeAgentToken(ctx context.Context, id, reason string) error {
+	var data struct {
+		AgentTokenRevoke struct {
+			AgentToken struct {
+				ID string `json:"id"`
+			} `json:"agentToken"`
+		} `json:"agentTokenRevoke"`
+	}
+	err := c.graphQL(ctx, `mutation($id: ID!, $reason: String!) {
+  agentTokenRevoke(input: {id: $id, reason: $reason}) { agentToken { id } }
+}`, map[string]interface{}{"id": id, "reason": reason}, &data)
+	if err != nil {
+		return err
+	}
+
+	c.Logger.Debug("Revoked agent token", "id", id, "reason", reason)
+	return nil
+}
+
+// ListAgentTokens returns every agent registration token in the
+// organization that hasn't been revoked.
+func (c *Client) ListAgentTokens(ctx context.Context, orgSlug string) ([]*AgentToken, error) {
+	var (
+		tokens []*AgentToken
+		cursor *string
+	)
+	for {
+		var data struct {
+			Organization *struct {
+				AgentTokens struct {
+					PageInfo struct {
+						HasNextPage bool   `json:"hasNextPage"`
+						EndCursor   string `json:"endCursor"`
+					} `json:"pageInfo"`
+					Edges []struct {
+						Node *AgentToken `json:"node"`
+					} `json:"edges"`
+				} `json:"agentTokens"`
+			} `json:"organization"`
+		}
+		err := c.graphQL(ctx, `query($slug: ID!, $after: String) {
+  organization(slug: $slug) {
+    agentTokens(first: 100, after: $after, revoked: false) {
+      pageInfo { hasNextPage endCursor }
+      edges { node { id description createdAt revokedAt } }
+    }
+  }
+}`, map[string]interface{}{"slug": orgSlug, "after": cursor}, &data)
+		if err != nil {
+			return nil, err
+		}
+		if data.Organization == nil {
+			return nil, fmt.Errorf("Organization %s not found", orgSlug)
+		}
+
+		for _, e := range data.Organization.AgentTokens.Edges {
+			if e.Node != nil && e.Node.RevokedAt == nil {
+				tokens = append(tokens, e.Node)
+			}
+		}
+
+		page := data.Organization.AgentTokens.PageInfo
+		if !page.HasNextPage {
+			break
+		}
+		cursor = &page.EndCursor
+	}
+
+	return tokens, nil
+}
+
+// Job is a command job, as returned by the GraphQL API.
+type Job struct {
+	UUID            string   `json:"uuid"`
+	State           string   `json:"state"`
+	AgentQueryRules []string `json:"agentQueryRules"`
+}
+
+// ActiveJobStates are the states of jobs that need, or are using, an agent.
+var ActiveJobStates = []string{"SCHEDULED", "ASSIGNED", "ACCEPTED", "RUNNING"}
+
+// ListJobs returns the command jobs in the organization that target the
+// queue and are in one of the given states, along with their agent query
+// rules.
+func (c *Client) ListJobs(ctx context.Context, orgSlug, queue string, states []string) ([]*Job, error) {
+	var (
+		jobs   []*Job
+		cursor *string
+	)
+	for {
+		var data struct {
+			Organization *struct {
+				Jobs struct {
+					PageInfo struct {
+						HasNextPage bool   `json:"hasNextPage"`
+						EndCursor   string `json:"endCursor"`
+					} `json:"pageInfo"`
+					Edges []struct {
+						Node *Job `json:"node"`
+					} `json:"edges"`
+				} `json:"jobs"`
+			} `json:"organization"`
+		}
+		err := c.graphQL(ctx, `query($slug: ID!, $rules: [String!], $states: [JobStates!], $after: String) {
+  organization(slug: $slug) {
+    jobs(first: 100, after: $after, type: [COMMAND], state: $states, agentQueryRules: $rules) {
+      pageInfo { hasNextPage endCursor }
+      edges { node { ... on JobTypeCommand { uuid state agentQueryRules } } }
+    }
+  }
+}`, map[string]interface{}{
+			"slug":   orgSlug,
+			"rules":  []string{"queue=" + queue},
+			"states": states,
+			"after":  cursor,
+		}, &data)
+		if err != nil {
+			return nil, err
+		}
+		if data.Organization == nil {
+			return nil, fmt.Errorf("Organization %s not found", orgSlug)
+		}
+
+		for _, e := range data.Organization.Jobs.Edges {
+			if e.Node != nil && e.Node.UUID != "" {
+				jobs = append(jobs, e.Node)
+			}
+		}
+
+		page := data.Organization.Jobs.PageInfo
+		if !page.HasNextPage {
+			break
+		}
+		cursor = &page.EndCursor
+	}
+
+	c.Logger.Debug("Listed jobs", "queue", queue, "count", len(jobs))
+	return jobs, nil
+}
@@ -0,0 +1,33 @@
+package buildkite
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "buildkite_gcp_scaler",
+	Subsystem: "buildkite",
+	Name:      "request_duration_seconds",
+	Help:      "Time taken for requests to the Buildkite API.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"endpoint"})
+
+var requestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "buildkite_gcp_scaler",
+	Subsystem: "buildkite",
+	Name:      "request_errors_total",
+	Help:      "Failed requests to the Buildkite API, by kind of failure.",
+}, []string{"endpoint", "kind"})
+
+var requestRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "buildkite_gcp_scaler",
+	Subsystem: "buildkite",
+	Name:      "request_retries_total",
+	Help:      "Requests to the Buildkite API that were retried.",
+}, []string{"endpoint"})
+
+func init() {
+	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(requestErrors)
+	prometheus.MustRegister(requestRetries)
+}
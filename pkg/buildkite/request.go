@@ -0,0 +1,119 @@
+package buildkite
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultMaxRetries is used when Client.MaxRetries is unset.
+	DefaultMaxRetries = 3
+
+	// retryBaseDelay is doubled on every retry, up to retryMaxDelay. A
+	// Retry-After header can ask for longer.
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// do sends a request to Buildkite. Idempotent requests that fail with a
+// network error, a rate limit or a server error are retried with exponential
+// backoff; others are not, since the failure may have come after Buildkite
+// acted on them. Rate limited requests wait for as long as Retry-After asks,
+// unless that's longer than the backoff allows, in which case the error is
+// returned rather than stalling the caller. Responses with a status outside
+// 2xx are returned as an *APIError, and the caller must close the body of
+// successful responses.
+func (c *Client) do(ctx context.Context, endpoint, method, url, authorization string, body []byte, idempotent bool) (*http.Response, error) {
+	maxRetries := c.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	if !idempotent {
+		maxRetries = -1
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := c.send(ctx, endpoint, method, url, authorization, body)
+		if err == nil {
+			return res, nil
+		}
+		requestErrors.WithLabelValues(endpoint, errorKind(err)).Inc()
+
+		wait := retryBaseDelay << uint(attempt)
+		if wait > retryMaxDelay {
+			wait = retryMaxDelay
+		}
+		if apiErr, ok := err.(*APIError); ok {
+			if !apiErr.Temporary() || apiErr.RetryAfter > retryMaxDelay {
+				return nil, err
+			}
+			if apiErr.RetryAfter > wait {
+				wait = apiErr.RetryAfter
+			}
+		}
+		if ctx.Err() != nil || attempt >= maxRetries {
+			return nil, err
+		}
+
+		c.Logger.Warn("Retrying Buildkite request", "endpoint", endpoint, "error", err, "attempt", attempt+1, "wait", wait)
+		requestRetries.WithLabelValues(endpoint).Inc()
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, endpoint, method, url, authorization string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", c.UserAgent)
+	req.Header.Set("Authorization", authorization)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	t := time.Now()
+	res, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	requestDuration.WithLabelValues(endpoint).Observe(time.Now().Sub(t).Seconds())
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		return nil, &APIError{
+			Endpoint:   endpoint,
+			StatusCode: res.StatusCode,
+			Status:     res.Status,
+			RetryAfter: retryAfter(res.Header.Get("Retry-After")),
+		}
+	}
+
+	return res, nil
+}
+
+// retryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,222 @@
+package buildkite
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// testServer responds to each request with the next of the given statuses,
+// repeating the last one, and counts the requests it receives.
+func testServer(header http.Header, statuses ...int) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&requests, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		status := statuses[n-1]
+
+		if status != http.StatusOK {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+		}
+		w.WriteHeader(status)
+	}))
+	return srv, &requests
+}
+
+func testClient(maxRetries int) *Client {
+	return &Client{
+		UserAgent:  "test",
+		HTTPClient: http.DefaultClient,
+		Logger:     hclog.NewNullLogger(),
+		MaxRetries: maxRetries,
+	}
+}
+
+func TestDo(t *testing.T) {
+	cases := []struct {
+		name       string
+		method     string
+		idempotent bool
+		maxRetries int
+		header     http.Header
+		statuses   []int
+
+		requests int32
+		success  bool
+	}{
+		{
+			name:       "succeeds without retrying",
+			method:     "GET",
+			idempotent: true,
+			statuses:   []int{http.StatusOK},
+			requests:   1,
+			success:    true,
+		},
+		{
+			name:       "accepts any 2xx status",
+			method:     "PUT",
+			idempotent: true,
+			statuses:   []int{http.StatusNoContent},
+			requests:   1,
+			success:    true,
+		},
+		{
+			name:       "doesn't retry unauthorized requests",
+			method:     "GET",
+			idempotent: true,
+			statuses:   []int{http.StatusUnauthorized, http.StatusOK},
+			requests:   1,
+		},
+		{
+			name:       "doesn't retry client errors",
+			method:     "GET",
+			idempotent: true,
+			statuses:   []int{http.StatusNotFound, http.StatusOK},
+			requests:   1,
+		},
+		{
+			name:       "retries rate limited requests",
+			method:     "GET",
+			idempotent: true,
+			statuses:   []int{http.StatusTooManyRequests, http.StatusOK},
+			requests:   2,
+			success:    true,
+		},
+		{
+			name:       "waits for Retry-After",
+			method:     "GET",
+			idempotent: true,
+			header:     http.Header{"Retry-After": []string{"1"}},
+			statuses:   []int{http.StatusTooManyRequests, http.StatusOK},
+			requests:   2,
+			success:    true,
+		},
+		{
+			name:       "gives up when Retry-After is too long",
+			method:     "GET",
+			idempotent: true,
+			header:     http.Header{"Retry-After": []string{"60"}},
+			statuses:   []int{http.StatusTooManyRequests, http.StatusOK},
+			requests:   1,
+		},
+		{
+			name:       "gives up when a Retry-After date is too far away",
+			method:     "GET",
+			idempotent: true,
+			header:     http.Header{"Retry-After": []string{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}},
+			statuses:   []int{http.StatusTooManyRequests, http.StatusOK},
+			requests:   1,
+		},
+		{
+			name:       "retries server errors",
+			method:     "GET",
+			idempotent: true,
+			maxRetries: 2,
+			statuses:   []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK},
+			requests:   3,
+			success:    true,
+		},
+		{
+			name:       "retries server errors up to the limit",
+			method:     "GET",
+			idempotent: true,
+			maxRetries: 2,
+			statuses:   []int{http.StatusInternalServerError},
+			requests:   3,
+		},
+		{
+			name:       "doesn't retry when retries are disabled",
+			method:     "GET",
+			idempotent: true,
+			maxRetries: -1,
+			statuses:   []int{http.StatusInternalServerError, http.StatusOK},
+			requests:   1,
+		},
+		{
+			name:     "doesn't retry non-idempotent requests",
+			method:   "POST",
+			statuses: []int{http.StatusInternalServerError, http.StatusOK},
+			requests: 1,
+		},
+		{
+			name:     "doesn't retry rate limited non-idempotent requests",
+			method:   "POST",
+			statuses: []int{http.StatusTooManyRequests, http.StatusOK},
+			requests: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, requests := testServer(tc.header, tc.statuses...)
+			defer srv.Close()
+			c := testClient(tc.maxRetries)
+
+			res, err := c.do(context.Background(), "test", tc.method, srv.URL, "Bearer token", []byte(`{}`), tc.idempotent)
+			if res != nil {
+				res.Body.Close()
+			}
+
+			if tc.success && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tc.success {
+				if _, ok := err.(*APIError); !ok {
+					t.Errorf("expected an *APIError, got %v", err)
+				}
+			}
+			if got := atomic.LoadInt32(requests); got != tc.requests {
+				t.Errorf("sent %d requests, expected %d", got, tc.requests)
+			}
+		})
+	}
+}
+
+func TestDo_Cancelled(t *testing.T) {
+	srv, requests := testServer(nil, http.StatusInternalServerError)
+	defer srv.Close()
+	c := testClient(5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := c.do(ctx, "test", "GET", srv.URL, "Bearer token", nil, true); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := atomic.LoadInt32(requests); got > 1 {
+		t.Errorf("sent %d requests after cancellation", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cases := []struct {
+		header string
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"", 0, 0},
+		{"0", 0, 0},
+		{"-5", 0, 0},
+		{"garbage", 0, 0},
+		{"5", 5 * time.Second, 5 * time.Second},
+		{"120", 2 * time.Minute, 2 * time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+	}
+
+	for _, tc := range cases {
+		got := retryAfter(tc.header)
+		if got < tc.min || got > tc.max {
+			t.Errorf("retryAfter(%q) = %s, expected between %s and %s", tc.header, got, tc.min, tc.max)
+		}
+	}
+}
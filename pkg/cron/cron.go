@@ -0,0 +1,162 @@
+// Package cron parses standard five-field cron expressions and reports which
+// times they match.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression of the form
+//
+//	minute hour day-of-month month day-of-week
+//
+// Each field is *, a value, a range (1-5), a list (1,3,5) or any of those
+// with a step (*/15, 9-17/2). Months and days of the week may be given by
+// their three letter English names, and Sunday is either 0 or 7.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// domStar and dowStar record whether the day fields started with *,
+	// since cron matches either day field when both are restricted.
+	domStar, dowStar bool
+}
+
+type field struct {
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	minuteField = field{min: 0, max: 59}
+	hourField   = field{min: 0, max: 23}
+	domField    = field{min: 1, max: 31}
+	monthField  = field{min: 1, max: 12, names: map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = field{min: 0, max: 7, names: map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// Parse parses a five-field cron expression.
+func Parse(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in %q, got %d", expr, len(fields))
+	}
+
+	var (
+		s   Schedule
+		err error
+	)
+	if s.minute, err = minuteField.parse(fields[0]); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if s.hour, err = hourField.parse(fields[1]); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if s.dom, err = domField.parse(fields[2]); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if s.month, err = monthField.parse(fields[3]); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if s.dow, err = dowField.parse(fields[4]); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+
+	// Sunday may be written as 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	// As in Vixie cron, a day field starting with * counts as unrestricted
+	// even with a step, so "*/2 * 1" matches every other day on Mondays.
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return &s, nil
+}
+
+// Matches reports whether the minute containing t matches the schedule, in
+// t's location.
+func (s *Schedule) Matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 ||
+		s.hour&(1<<uint(t.Hour())) == 0 ||
+		s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// parse returns a bitmask with a bit set for every value the field matches.
+func (f field) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		step := uint(1)
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.ParseUint(part[i+1:], 10, 8)
+			if err != nil || n == 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = uint(n)
+			part = part[:i]
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(bounds[1]); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			v, err := f.value(part)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if step == 1 {
+				hi = v
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+
+	return bits, nil
+}
+
+func (f field) value(s string) (uint, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if uint(n) < f.min || uint(n) > f.max {
+		return 0, fmt.Errorf("%d is out of range %d-%d", n, f.min, f.max)
+	}
+	return uint(n), nil
+}
@@ -0,0 +1,95 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse_Invalid(t *testing.T) {
+	cases := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"* * * foo *",
+	}
+
+	for _, expr := range cases {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := Parse(expr); err == nil {
+				t.Fatalf("Parse(%q) succeeded, expected an error", expr)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	// 2024-01-01 was a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		name  string
+		expr  string
+		time  time.Time
+		match bool
+	}{
+		{"every minute", "* * * * *", at(1, 0, 0), true},
+		{"value", "30 9 * * *", at(1, 9, 30), true},
+		{"value mismatch", "30 9 * * *", at(1, 9, 31), false},
+		{"range start", "* 9-17 * * *", at(1, 9, 0), true},
+		{"range end", "* 9-17 * * *", at(1, 17, 59), true},
+		{"outside range", "* 9-17 * * *", at(1, 18, 0), false},
+		{"list", "0,15,30 * * * *", at(1, 3, 15), true},
+		{"list mismatch", "0,15,30 * * * *", at(1, 3, 20), false},
+		{"step", "*/15 * * * *", at(1, 3, 45), true},
+		{"step mismatch", "*/15 * * * *", at(1, 3, 50), false},
+		{"range with step", "* 9-17/2 * * *", at(1, 11, 0), true},
+		{"range with step mismatch", "* 9-17/2 * * *", at(1, 12, 0), false},
+		{"value with step", "5/20 * * * *", at(1, 0, 45), true},
+		{"month name", "* * * jan *", at(1, 0, 0), true},
+		{"month name mismatch", "* * * feb *", at(1, 0, 0), false},
+		{"day name", "* * * * MON", at(1, 0, 0), true},
+		{"day name range", "* * * * mon-fri", at(6, 0, 0), false},
+		{"sunday as 0", "* * * * 0", at(7, 0, 0), true},
+		{"sunday as 7", "* * * * 7", at(7, 0, 0), true},
+		{"weekdays on saturday", "* * * * 1-5", at(6, 0, 0), false},
+		{"day of month", "* * 15 * *", at(15, 0, 0), true},
+		{"day of month mismatch", "* * 15 * *", at(14, 0, 0), false},
+
+		// When both day fields are restricted, either may match.
+		{"both days, dom matches", "* * 15 * 1", at(15, 0, 0), true},
+		{"both days, dow matches", "* * 15 * 1", at(8, 0, 0), true},
+		{"both days, neither matches", "* * 15 * 1", at(9, 0, 0), false},
+
+		// A stepped * is still unrestricted, so both fields must match.
+		{"stepped dom with dow, both match", "* * */2 * 1", at(15, 0, 0), true},
+		{"stepped dom with dow, only dow matches", "* * */2 * 1", at(8, 0, 0), false},
+		{"stepped dom with dow, only dom matches", "* * */2 * 1", at(3, 0, 0), false},
+		{"dom with stepped dow, only dom matches", "* * 3 * */2", at(3, 0, 0), false},
+		{"dom with stepped dow, both match", "* * 2 * */2", at(2, 0, 0), true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := Parse(tc.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", tc.expr, err)
+			}
+
+			if got := s.Matches(tc.time); got != tc.match {
+				t.Fatalf("Parse(%q).Matches(%s) = %v, expected %v", tc.expr, tc.time.Format(time.RFC1123), got, tc.match)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package gce
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/hashicorp/errwrap"
+	"google.golang.org/api/googleapi"
+)
+
+// OperationError is an error reported by a failed GCE operation.
+type OperationError struct {
+	Code    string
+	Message string
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("GCE Error %s: %s", e.Code, e.Message)
+}
+
+// capacityErrorCodes are the operation error codes GCE uses when a zone has
+// run out of a resource or the project has hit a quota.
+var capacityErrorCodes = map[string]bool{
+	"ZONE_RESOURCE_POOL_EXHAUSTED":              true,
+	"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS": true,
+	"QUOTA_EXCEEDED":                            true,
+}
+
+// IsCapacityError reports whether err, or any error wrapped by it, was caused
+// by a stockout or quota rather than by a problem with the request.
+func IsCapacityError(err error) bool {
+	capacity := false
+	errwrap.Walk(err, func(err error) {
+		switch e := err.(type) {
+		case *OperationError:
+			if capacityErrorCodes[e.Code] {
+				capacity = true
+			}
+		case *googleapi.Error:
+			for _, item := range e.Errors {
+				if item.Reason == "quotaExceeded" || capacityErrorCodes[item.Reason] {
+					capacity = true
+				}
+			}
+		}
+	})
+
+	return capacity
+}
+
+// isNotFound reports whether err, or any error wrapped by it, was caused by
+// the resource not existing.
+func isNotFound(err error) bool {
+	found := false
+	errwrap.Walk(err, func(err error) {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+			found = true
+		}
+	})
+	return found
+}
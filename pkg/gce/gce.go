@@ -5,51 +5,79 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"time"
 
 	"github.com/cenkalti/backoff"
+	"github.com/hashicorp/errwrap"
 	hclog "github.com/hashicorp/go-hclog"
 	multierror "github.com/hashicorp/go-multierror"
 	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
 type Client struct {
-	svc    *compute.Service
-	gSvc   *compute.InstanceGroupsService
-	iSvc   *compute.InstancesService
+	svc  *compute.Service
+	gSvc *compute.InstanceGroupsService
+	iSvc *compute.InstancesService
+	// http is the authenticated client behind svc, for calls the generated
+	// client doesn't fully support.
+	http   *http.Client
 	logger hclog.Logger
 }
 
 func NewClient(logger hclog.Logger) (*Client, error) {
 	ctx := context.Background()
-	computeService, err := compute.NewService(ctx)
+	httpClient, endpoint, err := htransport.NewClient(ctx, option.WithScopes(compute.ComputeScope))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to instantiate Compute Service: %v", err)
 	}
+	computeService, err := compute.New(httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to instantiate Compute Service: %v", err)
+	}
+	if endpoint != "" {
+		computeService.BasePath = endpoint
+	}
 
 	return &Client{
 		svc:    computeService,
+		http:   httpClient,
 		logger: logger,
 		gSvc:   compute.NewInstanceGroupsService(computeService),
 		iSvc:   compute.NewInstancesService(computeService),
 	}, nil
 }
 
-func (c *Client) LiveInstanceCount(ctx context.Context, projectID, zone, instanceGroupName string) (int64, error) {
-	result, err := c.gSvc.ListInstances(projectID, zone, instanceGroupName, &compute.InstanceGroupsListInstancesRequest{}).
-		Context(ctx).
-		Do()
+// RemoveInstancesFromGroup removes references to the given instances from an
+// unmanaged group without deleting the instances themselves.
+func (c *Client) RemoveInstancesFromGroup(ctx context.Context, projectID, zone, groupName string, instances []*Instance) error {
+	req := &compute.InstanceGroupsRemoveInstancesRequest{}
+	for _, i := range instances {
+		c.logger.Info("Removing instance from group", "name", i.Name, "group", groupName)
+		req.Instances = append(req.Instances, &compute.InstanceReference{Instance: i.SelfLink})
+	}
+
+	op, err := c.gSvc.RemoveInstances(projectID, zone, groupName, req).Context(ctx).Do()
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("Failed to remove instances from group: %v", err)
 	}
 
-	count := int64(0)
-	for _, i := range result.Items {
-		if i.Status == "PROVISIONING" || i.Status == "RUNNING" {
-			count++
-		}
+	return c.waitForOperationCompletion(ctx, projectID, zone, op)
+}
+
+func (c *Client) DeleteInstance(ctx context.Context, projectID, zone, name string) error {
+	c.logger.Info("Deleting instance", "name", name)
+
+	op, err := c.iSvc.Delete(projectID, zone, name).Context(ctx).Do()
+	if err != nil {
+		return errwrap.Wrapf("Failed to delete vm: {{err}}", err)
 	}
 
-	return count, nil
+	return c.waitForOperationCompletion(ctx, projectID, zone, op)
 }
 
 func randomHex(n int) (string, error) {
@@ -60,44 +88,94 @@ func randomHex(n int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
-func (c *Client) waitForOperationCompletion(ctx context.Context, projectID, zone string, o *compute.Operation) error {
-	svc := compute.NewZoneOperationsService(c.svc)
+func (c *Client) waitForOperationCompletion(ctx context.Context, projectID, zone string, o *compute.Operation) (err error) {
+	t := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		operationDuration.WithLabelValues(o.OperationType, result).Observe(time.Now().Sub(t).Seconds())
+	}()
+
+	zoneOps := compute.NewZoneOperationsService(c.svc)
+	regionOps := compute.NewRegionOperationsService(c.svc)
 	operation := func() error {
-		req := svc.Get(projectID, zone, o.Name)
-		o, err := req.Context(ctx).Do()
+		var (
+			op  *compute.Operation
+			err error
+		)
+		if o.Region != "" {
+			// Regional resources, such as regional managed instance groups,
+			// return regional operations.
+			op, err = regionOps.Get(projectID, path.Base(o.Region), o.Name).Context(ctx).Do()
+		} else {
+			op, err = zoneOps.Get(projectID, zone, o.Name).Context(ctx).Do()
+		}
 		if err != nil {
 			return backoff.Permanent(err)
 		}
-		c.logger.Debug("operation status", "status", o.Status)
+		c.logger.Debug("operation status", "status", op.Status)
 
-		if o.Error != nil {
+		if op.Error != nil {
 			var oErr error
-			for _, err := range o.Error.Errors {
-				oErr = multierror.Append(fmt.Errorf("GCE Error %s: %s", err.Code, err.Message))
+			for _, err := range op.Error.Errors {
+				oErr = multierror.Append(oErr, &OperationError{Code: err.Code, Message: err.Message})
 			}
 			return backoff.Permanent(oErr)
 		}
 
-		if o.Status == "DONE" {
+		if op.Status == "DONE" {
 			return nil
 		}
 
-		return fmt.Errorf("Operation status: %s", o.Status)
+		return fmt.Errorf("Operation status: %s", op.Status)
 	}
 
-	return backoff.Retry(operation, backoff.NewExponentialBackOff())
+	return backoff.Retry(operation, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
 }
 
-func (c *Client) LaunchInstanceForGroup(ctx context.Context, projectID, zone, groupName, templateName string) error {
+// InstanceName generates a name for a new instance created from the given
+// template.
+func InstanceName(templateName string) (string, error) {
 	suffix, err := randomHex(3)
 	if err != nil {
-		return err
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s", templateName, suffix), nil
+}
+
+// LaunchOptions customises an instance created by LaunchInstanceForGroup.
+type LaunchOptions struct {
+	// Name defaults to a name generated by InstanceName.
+	Name string
+	// Metadata and Labels are merged over those of the instance template.
+	Metadata map[string]string
+	Labels   map[string]string
+}
+
+func (c *Client) LaunchInstanceForGroup(ctx context.Context, projectID, zone, groupName, templateName string, opts *LaunchOptions) error {
+	if opts == nil {
+		opts = &LaunchOptions{}
+	}
+
+	iName := opts.Name
+	if iName == "" {
+		var err error
+		if iName, err = InstanceName(templateName); err != nil {
+			return err
+		}
 	}
-	iName := fmt.Sprintf("%s-%s", templateName, suffix)
 	instance := &compute.Instance{
 		Name: iName,
 	}
 
+	if len(opts.Metadata) > 0 || len(opts.Labels) > 0 {
+		if err := c.mergeTemplate(ctx, projectID, templateName, instance, opts); err != nil {
+			return err
+		}
+	}
+
 	c.logger.Info("Creating instance", "name", iName)
 
 	createOp, err := c.iSvc.Insert(projectID, zone, instance).
@@ -105,23 +183,107 @@ func (c *Client) LaunchInstanceForGroup(ctx context.Context, projectID, zone, gr
 		Context(ctx).
 		Do()
 	if err != nil {
-		return fmt.Errorf("Failed to create vm: %v", err)
+		return errwrap.Wrapf("Failed to create vm: {{err}}", err)
 	}
 
-	// Add to the group
+	if err := c.waitForOperationCompletion(ctx, projectID, zone, createOp); err != nil {
+		// The pass may have been cancelled or polling failed while the vm
+		// was still being created.
+		c.logger.Warn("Creating instance failed, deleting it", "name", iName, "error", err)
+		return c.cleanUpInstance(projectID, zone, iName, errwrap.Wrapf(fmt.Sprintf("Failed to create vm %s: {{err}}", iName), err))
+	}
 
+	if err := c.addInstanceToGroup(ctx, projectID, zone, groupName, createOp.TargetLink); err != nil {
+		c.logger.Warn("Adding instance to group failed, deleting it", "name", iName, "group", groupName, "error", err)
+		return c.cleanUpInstance(projectID, zone, iName, err)
+	}
+
+	return nil
+}
+
+// cleanUpInstance deletes an instance that couldn't be launched, if it was
+// created at all, and returns the error that caused the launch to fail. It
+// uses a fresh context so that cancelling the pass doesn't leave an orphaned
+// VM behind.
+func (c *Client) cleanUpInstance(projectID, zone, name string, err error) error {
+	if dErr := c.DeleteInstance(context.Background(), projectID, zone, name); dErr != nil && !isNotFound(dErr) {
+		return multierror.Append(err, fmt.Errorf("Failed to clean up vm %s: %v", name, dErr))
+	}
+	return err
+}
+
+// mergeTemplate sets the metadata and labels of an instance to those of its
+// template with the options merged over them. Metadata and labels set on an
+// instance replace those of its template rather than being merged, so the
+// template's must be copied.
+func (c *Client) mergeTemplate(ctx context.Context, projectID, templateName string, instance *compute.Instance, opts *LaunchOptions) error {
+	tmpl, err := compute.NewInstanceTemplatesService(c.svc).Get(projectID, templateName).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("Failed to get instance template %s: %v", templateName, err)
+	}
+	props := tmpl.Properties
+	if props == nil {
+		props = &compute.InstanceProperties{}
+	}
+
+	if len(opts.Metadata) > 0 {
+		metadata := &compute.Metadata{}
+		if props.Metadata != nil {
+			for _, item := range props.Metadata.Items {
+				if _, ok := opts.Metadata[item.Key]; !ok {
+					metadata.Items = append(metadata.Items, item)
+				}
+			}
+		}
+
+		keys := make([]string, 0, len(opts.Metadata))
+		for k := range opts.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := opts.Metadata[k]
+			metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: k, Value: &v})
+		}
+
+		instance.Metadata = metadata
+	}
+
+	if len(opts.Labels) > 0 {
+		labels := make(map[string]string, len(props.Labels)+len(opts.Labels))
+		for k, v := range props.Labels {
+			labels[k] = v
+		}
+		for k, v := range opts.Labels {
+			labels[k] = v
+		}
+
+		instance.Labels = labels
+	}
+
+	return nil
+}
+
+// addInstanceToGroup adds an existing instance to an unmanaged group,
+// retrying a few times before giving up.
+func (c *Client) addInstanceToGroup(ctx context.Context, projectID, zone, groupName, instanceLink string) error {
 	req := &compute.InstanceGroupsAddInstancesRequest{
 		Instances: []*compute.InstanceReference{
 			{
-				Instance: createOp.TargetLink,
+				Instance: instanceLink,
 			},
 		},
 	}
 
-	ao, err := c.gSvc.AddInstances(projectID, zone, groupName, req).Context(ctx).Do()
-	if err != nil {
-		return err
+	operation := func() error {
+		ao, err := c.gSvc.AddInstances(projectID, zone, groupName, req).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+
+		return c.waitForOperationCompletion(ctx, projectID, zone, ao)
 	}
 
-	return c.waitForOperationCompletion(ctx, projectID, zone, ao)
+	b := backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 3)
+	return backoff.Retry(operation, backoff.WithContext(b, ctx))
 }
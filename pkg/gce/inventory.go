@@ -0,0 +1,177 @@
+package gce
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// StatusMissing is reported for members of an unmanaged group whose instance
+// no longer exists.
+const StatusMissing = "MISSING"
+
+// Instance is a member of an instance group.
+type Instance struct {
+	Name     string `json:"name"`
+	Zone     string `json:"zone"`
+	Status   string `json:"status"`
+	SelfLink string `json:"self_link"`
+
+	// CreatedAt and Labels are unset for managed instances that GCE hasn't
+	// created yet.
+	CreatedAt time.Time         `json:"created_at"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// Pending reports whether the instance is being created or is booting.
+// Managed instances that GCE hasn't created yet have no status.
+func (i *Instance) Pending() bool {
+	switch i.Status {
+	case "", "PROVISIONING", "STAGING":
+		return true
+	}
+	return false
+}
+
+// Available reports whether the instance is running.
+func (i *Instance) Available() bool {
+	return i.Status == "RUNNING"
+}
+
+// Draining reports whether the instance is shutting down and will not take
+// new jobs.
+func (i *Instance) Draining() bool {
+	return i.Status == "STOPPING" || i.Status == "SUSPENDING"
+}
+
+// Live reports whether the instance is running or on its way. Stopped
+// instances, including preempted Spot VMs which GCE leaves TERMINATED, are
+// treated as gone.
+func (i *Instance) Live() bool {
+	return i.Pending() || i.Available()
+}
+
+// Age returns how long ago the instance was created, or zero if unknown.
+func (i *Instance) Age() time.Duration {
+	if i.CreatedAt.IsZero() {
+		return 0
+	}
+	return time.Since(i.CreatedAt)
+}
+
+// FromTemplate reports whether the instance was created from the named
+// template by LaunchInstanceForGroup, based on its name.
+func (i *Instance) FromTemplate(templateName string) bool {
+	prefix := templateName + "-"
+	if !strings.HasPrefix(i.Name, prefix) {
+		return false
+	}
+
+	// Rule out templates that share a prefix, such as agent and agent-spot.
+	_, err := hex.DecodeString(strings.TrimPrefix(i.Name, prefix))
+	return err == nil
+}
+
+// ListGroupInstances returns every member of an unmanaged group along with
+// its status, creation time and labels. Members whose instance has been
+// deleted are reported with StatusMissing.
+func (c *Client) ListGroupInstances(ctx context.Context, projectID, zone, instanceGroupName string) ([]*Instance, error) {
+	var links []string
+	err := c.gSvc.ListInstances(projectID, zone, instanceGroupName, &compute.InstanceGroupsListInstancesRequest{}).
+		Pages(ctx, func(page *compute.InstanceGroupsListInstances) error {
+			for _, i := range page.Items {
+				links = append(links, i.Instance)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	if len(links) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(links))
+	for _, link := range links {
+		names = append(names, path.Base(link))
+	}
+
+	existing, err := c.listInstancesByName(ctx, projectID, zone, names)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]*Instance, 0, len(links))
+	for _, link := range links {
+		i, ok := existing[path.Base(link)]
+		if !ok {
+			i = &Instance{
+				Name:     path.Base(link),
+				Zone:     zone,
+				Status:   StatusMissing,
+				SelfLink: link,
+			}
+		}
+		instances = append(instances, i)
+	}
+
+	return instances, nil
+}
+
+// instanceFilterBatch is the number of names listInstancesByName filters
+// for in a single request, keeping the filter to a reasonable length.
+const instanceFilterBatch = 50
+
+// listInstancesByName returns the named instances of the zone that exist,
+// keyed by name. Only the named instances are listed, so that the cost
+// doesn't grow with the other instances in a shared zone.
+func (c *Client) listInstancesByName(ctx context.Context, projectID, zone string, names []string) (map[string]*Instance, error) {
+	instances := make(map[string]*Instance, len(names))
+	for start := 0; start < len(names); start += instanceFilterBatch {
+		end := start + instanceFilterBatch
+		if end > len(names) {
+			end = len(names)
+		}
+
+		clauses := make([]string, 0, end-start)
+		for _, name := range names[start:end] {
+			clauses = append(clauses, fmt.Sprintf("(name = %q)", name))
+		}
+
+		if err := c.listZoneInstances(ctx, projectID, zone, strings.Join(clauses, " OR "), instances); err != nil {
+			return nil, err
+		}
+	}
+
+	return instances, nil
+}
+
+// listZoneInstances adds the instances in the zone that match the filter to
+// instances, keyed by name.
+func (c *Client) listZoneInstances(ctx context.Context, projectID, zone, filter string, instances map[string]*Instance) error {
+	return c.iSvc.List(projectID, zone).
+		Filter(filter).
+		Pages(ctx, func(page *compute.InstanceList) error {
+			for _, i := range page.Items {
+				createdAt, err := time.Parse(time.RFC3339, i.CreationTimestamp)
+				if err != nil {
+					return fmt.Errorf("Invalid creation timestamp for %s: %v", i.Name, err)
+				}
+
+				instances[i.Name] = &Instance{
+					Name:      i.Name,
+					Zone:      zone,
+					Status:    i.Status,
+					SelfLink:  i.SelfLink,
+					CreatedAt: createdAt,
+					Labels:    i.Labels,
+				}
+			}
+			return nil
+		})
+}
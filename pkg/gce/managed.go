@@ -0,0 +1,187 @@
+package gce
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// ManagedGroup identifies a managed instance group. Exactly one of Zone and
+// Region is set, depending on whether the group is zonal or regional.
+type ManagedGroup struct {
+	Project string
+	Zone    string
+	Region  string
+	Name    string
+}
+
+func (g *ManagedGroup) regional() bool {
+	return g.Region != ""
+}
+
+func (g *ManagedGroup) String() string {
+	if g.regional() {
+		return fmt.Sprintf("projects/%s/regions/%s/instanceGroupManagers/%s", g.Project, g.Region, g.Name)
+	}
+	return fmt.Sprintf("projects/%s/zones/%s/instanceGroupManagers/%s", g.Project, g.Zone, g.Name)
+}
+
+// ListManagedInstances returns the members of the group that aren't already
+// being removed, along with the status, creation time and labels of those
+// that GCE has created.
+func (c *Client) ListManagedInstances(ctx context.Context, g *ManagedGroup) ([]*Instance, error) {
+	managed, err := c.listManagedInstancePages(ctx, g)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		instances []*Instance
+		names     = make(map[string][]string)
+	)
+	for _, mi := range managed {
+		if mi.CurrentAction == "DELETING" || mi.CurrentAction == "ABANDONING" {
+			continue
+		}
+
+		// Instance links have the form .../zones/{zone}/instances/{name}.
+		i := &Instance{
+			Name:     path.Base(mi.Instance),
+			Zone:     path.Base(path.Dir(path.Dir(mi.Instance))),
+			Status:   mi.InstanceStatus,
+			SelfLink: mi.Instance,
+		}
+		names[i.Zone] = append(names[i.Zone], i.Name)
+		instances = append(instances, i)
+	}
+
+	// Regional groups span several zones, so list each zone only once.
+	existing := make(map[string]map[string]*Instance, len(names))
+	for zone, zoneNames := range names {
+		var err error
+		existing[zone], err = c.listInstancesByName(ctx, g.Project, zone, zoneNames)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, i := range instances {
+		if e, ok := existing[i.Zone][i.Name]; ok {
+			i.CreatedAt = e.CreatedAt
+			i.Labels = e.Labels
+		}
+	}
+
+	return instances, nil
+}
+
+// managedInstancesPage is a page of listManagedInstances results. The
+// generated client drops nextPageToken from the response, so later pages
+// would be lost.
+type managedInstancesPage struct {
+	ManagedInstances []*compute.ManagedInstance `json:"managedInstances"`
+	NextPageToken    string                     `json:"nextPageToken"`
+}
+
+// listManagedInstancePages calls listManagedInstances for every page of the
+// group's members.
+func (c *Client) listManagedInstancePages(ctx context.Context, g *ManagedGroup) ([]*compute.ManagedInstance, error) {
+	location := "zones/" + g.Zone
+	if g.regional() {
+		location = "regions/" + g.Region
+	}
+	endpoint := googleapi.ResolveRelative(c.svc.BasePath, fmt.Sprintf("%s/%s/instanceGroupManagers/%s/listManagedInstances",
+		url.PathEscape(g.Project), location, url.PathEscape(g.Name)))
+
+	var (
+		managed []*compute.ManagedInstance
+		token   string
+	)
+	for {
+		params := url.Values{"alt": {"json"}, "prettyPrint": {"false"}}
+		if token != "" {
+			params.Set("pageToken", token)
+		}
+
+		req, err := http.NewRequest("POST", endpoint+"?"+params.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := c.http.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		var page managedInstancesPage
+		err = googleapi.CheckResponse(res)
+		if err == nil {
+			err = json.NewDecoder(res.Body).Decode(&page)
+		}
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list managed instances: %v", err)
+		}
+
+		managed = append(managed, page.ManagedInstances...)
+		if page.NextPageToken == "" {
+			return managed, nil
+		}
+		token = page.NextPageToken
+	}
+}
+
+// ResizeManagedGroup sets the target size of the group and waits for the
+// request to be accepted. The group creates or removes instances
+// asynchronously.
+func (c *Client) ResizeManagedGroup(ctx context.Context, g *ManagedGroup, size int64) error {
+	c.logger.Info("Resizing managed instance group", "group", g.String(), "size", size)
+
+	var (
+		op  *compute.Operation
+		err error
+	)
+	if g.regional() {
+		op, err = compute.NewRegionInstanceGroupManagersService(c.svc).Resize(g.Project, g.Region, g.Name, size).Context(ctx).Do()
+	} else {
+		op, err = compute.NewInstanceGroupManagersService(c.svc).Resize(g.Project, g.Zone, g.Name, size).Context(ctx).Do()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to resize group: %v", err)
+	}
+
+	return c.waitForOperationCompletion(ctx, g.Project, g.Zone, op)
+}
+
+// DeleteManagedInstances deletes specific members of the group, reducing
+// its target size accordingly.
+func (c *Client) DeleteManagedInstances(ctx context.Context, g *ManagedGroup, instances []*Instance) error {
+	links := make([]string, 0, len(instances))
+	for _, i := range instances {
+		c.logger.Info("Deleting managed instance", "name", i.Name, "group", g.String())
+		links = append(links, i.SelfLink)
+	}
+
+	var (
+		op  *compute.Operation
+		err error
+	)
+	if g.regional() {
+		req := &compute.RegionInstanceGroupManagersDeleteInstancesRequest{Instances: links}
+		op, err = compute.NewRegionInstanceGroupManagersService(c.svc).DeleteInstances(g.Project, g.Region, g.Name, req).Context(ctx).Do()
+	} else {
+		req := &compute.InstanceGroupManagersDeleteInstancesRequest{Instances: links}
+		op, err = compute.NewInstanceGroupManagersService(c.svc).DeleteInstances(g.Project, g.Zone, g.Name, req).Context(ctx).Do()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to delete instances: %v", err)
+	}
+
+	return c.waitForOperationCompletion(ctx, g.Project, g.Zone, op)
+}
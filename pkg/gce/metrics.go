@@ -0,0 +1,17 @@
+package gce
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "buildkite_gcp_scaler",
+	Subsystem: "gce",
+	Name:      "operation_duration_seconds",
+	Help:      "Time taken for GCE operations to complete.",
+	Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+}, []string{"operation", "result"})
+
+func init() {
+	prometheus.MustRegister(operationDuration)
+}
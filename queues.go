@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/scaler"
+)
+
+// queueBindings collects repeated -queue flags. Each value is a comma
+// separated list of key=value pairs, for example:
+//
+//	-queue name=docker,instance-group=docker-agents,instance-template=docker-agent
+//
+// Keys that are omitted fall back to the equivalent global flag. Because
+// commas separate pairs, gcp-zones takes a colon separated list of zones.
+type queueBindings []string
+
+func (q *queueBindings) String() string {
+	return strings.Join(*q, " ")
+}
+
+func (q *queueBindings) Set(value string) error {
+	*q = append(*q, value)
+	return nil
+}
+
+// defaultQueueConfig returns a QueueConfig populated from the global flags.
+func defaultQueueConfig() *scaler.QueueConfig {
+	return &scaler.QueueConfig{
+		BuildkiteQueue:        buildkiteQueue,
+		GCPZone:               googleCloudZone,
+		Zones:                 parseZones(googleCloudZones, ","),
+		GCPRegion:             googleCloudRegion,
+		InstanceGroupName:     googleCloudInstanceGroup,
+		InstanceGroupType:     googleCloudInstanceGroupType,
+		InstanceGroupTemplate: googleCloudTemplateName,
+		SpotInstanceTemplate:  googleCloudSpotTemplateName,
+		SpotRatio:             spotRatio,
+		MinInstances:          minInstances,
+		MaxInstances:          maxInstances,
+		MaxLaunchPerPass:      maxLaunchPerPass,
+		AgentsPerInstance:     agentsPerInstance,
+		TargetUtilization:     targetUtilization,
+		IdleTimeout:           idleTimeout,
+		ScaleInCooldown:       scaleInCooldown,
+		ScaleOutCooldown:      scaleOutCooldown,
+		ScaleInHysteresis:     scaleInHysteresis,
+		ProvisioningTimeout:   provisioningTimeout,
+		BootTimeout:           bootTimeout,
+		Placement:             placement,
+		ZoneFailureCooldown:   zoneFailureCooldown,
+	}
+}
+
+// parseZones splits a list of zones, each using the queue's instance group.
+func parseZones(value, sep string) []*scaler.ZoneConfig {
+	var zones []*scaler.ZoneConfig
+	for _, z := range strings.Split(value, sep) {
+		if z = strings.TrimSpace(z); z != "" {
+			zones = append(zones, &scaler.ZoneConfig{Zone: z})
+		}
+	}
+	return zones
+}
+
+// queueConfigs returns the configured queue bindings, or a single binding
+// built from the global flags when no -queue flags were given.
+func (q queueBindings) queueConfigs() ([]*scaler.QueueConfig, error) {
+	if len(q) == 0 {
+		return []*scaler.QueueConfig{defaultQueueConfig()}, nil
+	}
+
+	var configs []*scaler.QueueConfig
+	for _, binding := range q {
+		qc, err := parseQueueBinding(binding)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -queue %q: %v", binding, err)
+		}
+		configs = append(configs, qc)
+	}
+
+	return configs, nil
+}
+
+func parseQueueBinding(binding string) (*scaler.QueueConfig, error) {
+	qc := defaultQueueConfig()
+
+	for _, pair := range strings.Split(binding, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
+		}
+
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		var err error
+		switch key {
+		case "name":
+			qc.BuildkiteQueue = value
+		case "gcp-zone":
+			qc.GCPZone = value
+		case "gcp-zones":
+			qc.Zones = parseZones(value, ":")
+		case "gcp-region":
+			qc.GCPRegion = value
+		case "instance-group":
+			qc.InstanceGroupName = value
+		case "instance-group-type":
+			qc.InstanceGroupType = value
+		case "instance-template":
+			qc.InstanceGroupTemplate = value
+		case "spot-template":
+			qc.SpotInstanceTemplate = value
+		case "spot-ratio":
+			qc.SpotRatio, err = strconv.ParseFloat(value, 64)
+		case "min-instances":
+			qc.MinInstances, err = strconv.ParseInt(value, 10, 64)
+		case "max-instances":
+			qc.MaxInstances, err = strconv.ParseInt(value, 10, 64)
+		case "agents-per-instance":
+			qc.AgentsPerInstance, err = strconv.ParseInt(value, 10, 64)
+		case "target-utilization":
+			qc.TargetUtilization, err = strconv.ParseInt(value, 10, 64)
+		case "max-launch-per-pass":
+			qc.MaxLaunchPerPass, err = strconv.ParseInt(value, 10, 64)
+		case "placement":
+			qc.Placement = value
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+
+	return qc, nil
+}
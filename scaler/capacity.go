@@ -0,0 +1,44 @@
+package scaler
+
+import (
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+)
+
+// capacity summarises a group's instances by whether they can take jobs.
+type capacity struct {
+	// Pending instances are being created or are booting.
+	Pending int64
+	// Available instances are running.
+	Available int64
+	// Draining instances are shutting down and will not take new jobs.
+	Draining int64
+	// InFlight instances have been launched but aren't listed in the group
+	// yet.
+	InFlight int64
+
+	// ProfileShortfall is the number of instances the queue's profiles need
+	// for the jobs only they can run, beyond their live instances. Other
+	// instances can't make up for it.
+	ProfileShortfall int64
+}
+
+func newCapacity(instances []*gce.Instance) *capacity {
+	c := &capacity{}
+	for _, i := range instances {
+		switch {
+		case i.Pending():
+			c.Pending++
+		case i.Available():
+			c.Available++
+		case i.Draining():
+			c.Draining++
+		}
+	}
+	return c
+}
+
+// Live returns the number of instances in the group that can take jobs now
+// or soon.
+func (c *capacity) Live() int64 {
+	return c.Pending + c.Available
+}
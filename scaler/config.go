@@ -0,0 +1,264 @@
+package scaler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	DefaultIdleTimeout     = 10 * time.Minute
+	DefaultScaleInCooldown = 5 * time.Minute
+	DefaultSpotRatio       = 1.0
+
+	DefaultProvisioningTimeout = 15 * time.Minute
+
+	DefaultAgentsPerInstance = 1
+	DefaultTargetUtilization = 100
+)
+
+// DefaultQueueConfig returns a QueueConfig with every optional setting at its
+// default value.
+func DefaultQueueConfig() *QueueConfig {
+	return &QueueConfig{
+		IdleTimeout:         DefaultIdleTimeout,
+		ScaleInCooldown:     DefaultScaleInCooldown,
+		Placement:           PlacementRoundRobin,
+		ZoneFailureCooldown: DefaultZoneFailureCooldown,
+		SpotRatio:           DefaultSpotRatio,
+		ProvisioningTimeout: DefaultProvisioningTimeout,
+		BootTimeout:         DefaultBootTimeout,
+		AgentsPerInstance:   DefaultAgentsPerInstance,
+		TargetUtilization:   DefaultTargetUtilization,
+	}
+}
+
+// UnmarshalYAML applies the defaults from DefaultQueueConfig to any setting
+// that is not present in the file.
+func (q *QueueConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain QueueConfig
+	*q = *DefaultQueueConfig()
+	return unmarshal((*plain)(q))
+}
+
+// LoadConfigFile reads a YAML configuration file. Unknown keys are treated as
+// errors so that typos don't silently fall back to defaults.
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("Parsing %s failed: %v", path, err)
+	}
+
+	return &cfg, nil
+}
+
+// Validate checks that every required setting is present and that the
+// settings are consistent with each other, reporting all problems at once.
+func (c *Config) Validate() error {
+	var result error
+
+	if c.GCPProject == "" {
+		result = multierror.Append(result, fmt.Errorf("gcp_project is required"))
+	}
+	if c.BuildkiteToken == "" {
+		result = multierror.Append(result, fmt.Errorf("buildkite_token is required"))
+	}
+	if c.LaunchConcurrency < 0 {
+		result = multierror.Append(result, fmt.Errorf("launch_concurrency must not be negative"))
+	}
+	if c.UnhealthyAfterFailures < 0 || c.StaleAfterIntervals < 0 {
+		result = multierror.Append(result, fmt.Errorf("unhealthy_after_failures and stale_after_intervals must not be negative"))
+	}
+	if c.PollInterval != nil && *c.PollInterval <= 0 {
+		result = multierror.Append(result, fmt.Errorf("interval must be positive"))
+	}
+	if c.DynamicAgentTokens && c.BuildkiteAPIToken == "" {
+		result = multierror.Append(result, fmt.Errorf("dynamic_agent_tokens requires buildkite_api_token"))
+	}
+	if c.AgentTokenTTL < 0 {
+		result = multierror.Append(result, fmt.Errorf("agent_token_ttl must not be negative"))
+	}
+	if len(c.Queues) == 0 {
+		result = multierror.Append(result, fmt.Errorf("at least one queue is required"))
+	}
+
+	seen := make(map[string]bool, len(c.Queues))
+	for i, q := range c.Queues {
+		name := q.BuildkiteQueue
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		} else if seen[name] {
+			result = multierror.Append(result, fmt.Errorf("queue %s: defined more than once", name))
+		}
+		seen[name] = true
+
+		if len(q.Profiles) > 0 && c.BuildkiteAPIToken == "" {
+			result = multierror.Append(result, fmt.Errorf("queue %s: profiles require buildkite_api_token", name))
+		}
+		if c.DynamicAgentTokens && q.InstanceGroupType == GroupTypeManaged {
+			result = multierror.Append(result, fmt.Errorf("queue %s: dynamic_agent_tokens is only supported for unmanaged instance groups", name))
+		}
+
+		if err := q.validate(); err != nil {
+			result = multierror.Append(result, fmt.Errorf("queue %s: %v", name, err))
+		}
+	}
+
+	return result
+}
+
+func (q *QueueConfig) validate() error {
+	var errs []string
+
+	if q.BuildkiteQueue == "" {
+		errs = append(errs, "name is required")
+	}
+	if q.InstanceGroupName == "" && !q.zonesHaveGroups() {
+		errs = append(errs, "instance_group is required")
+	}
+
+	switch q.InstanceGroupType {
+	case "", GroupTypeUnmanaged:
+		if (q.GCPZone == "") == (len(q.Zones) == 0) {
+			errs = append(errs, "exactly one of gcp_zone and zones is required")
+		}
+		if q.GCPRegion != "" {
+			errs = append(errs, "gcp_region is only supported for managed instance groups")
+		}
+		if q.InstanceGroupTemplate == "" {
+			errs = append(errs, "instance_template is required")
+		}
+	case GroupTypeManaged:
+		if (q.GCPZone == "") == (q.GCPRegion == "") {
+			errs = append(errs, "exactly one of gcp_zone and gcp_region is required")
+		}
+		if len(q.Zones) > 0 {
+			errs = append(errs, "zones are only supported for unmanaged instance groups, use gcp_region instead")
+		}
+		if q.SpotInstanceTemplate != "" {
+			errs = append(errs, "spot_template is only supported for unmanaged instance groups")
+		}
+		if len(q.Labels) > 0 || len(q.Metadata) > 0 || len(q.AgentTags) > 0 {
+			errs = append(errs, "labels, metadata and agent_tags are only supported for unmanaged instance groups")
+		}
+		if len(q.Profiles) > 0 {
+			errs = append(errs, "profiles are only supported for unmanaged instance groups")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown instance_group_type %q", q.InstanceGroupType))
+	}
+	if q.AgentsPerInstance < 1 {
+		errs = append(errs, "agents_per_instance must be at least 1")
+	}
+	if q.TargetUtilization < 1 || q.TargetUtilization > 100 {
+		errs = append(errs, "target_utilization must be between 1 and 100")
+	}
+	if q.MinInstances < 0 || q.MaxInstances < 0 || q.MaxLaunchPerPass < 0 {
+		errs = append(errs, "instance counts must not be negative")
+	}
+	for i, sc := range q.Schedules {
+		name := sc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+
+		if _, err := sc.parse(); err != nil {
+			errs = append(errs, fmt.Sprintf("schedule %s: %v", name, err))
+		}
+		if sc.MinInstances < 0 {
+			errs = append(errs, fmt.Sprintf("schedule %s: min_instances must not be negative", name))
+		}
+		if q.MaxInstances > 0 && sc.MinInstances > q.MaxInstances {
+			errs = append(errs, fmt.Sprintf("schedule %s: min_instances (%d) must not exceed max_instances (%d)", name, sc.MinInstances, q.MaxInstances))
+		}
+	}
+	for k, v := range q.Labels {
+		if !labelKeyRegexp.MatchString(k) || !labelValueRegexp.MatchString(v) {
+			errs = append(errs, fmt.Sprintf("invalid label %s=%s, labels must be lowercase letters, digits, _ or -", k, v))
+		}
+	}
+	for k := range q.Metadata {
+		if k == "" {
+			errs = append(errs, "metadata keys must not be empty")
+		}
+	}
+	seenProfiles := make(map[string]bool, len(q.Profiles))
+	for i, p := range q.Profiles {
+		name := p.Name
+		switch {
+		case name == "":
+			name = fmt.Sprintf("#%d", i)
+			errs = append(errs, fmt.Sprintf("profile %s: name is required", name))
+		case seenProfiles[name]:
+			errs = append(errs, fmt.Sprintf("profile %s is listed more than once", name))
+		}
+		seenProfiles[name] = true
+
+		if p.InstanceTemplate == "" {
+			errs = append(errs, fmt.Sprintf("profile %s: instance_template is required", name))
+		} else if p.InstanceTemplate == q.InstanceGroupTemplate || p.InstanceTemplate == q.SpotInstanceTemplate {
+			errs = append(errs, fmt.Sprintf("profile %s: instance_template must differ from the queue's templates", name))
+		}
+	}
+	if q.Forecast != nil {
+		if err := q.Forecast.validate(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if q.MaxInstances > 0 && q.MinInstances > q.MaxInstances {
+		errs = append(errs, fmt.Sprintf("min_instances (%d) must not exceed max_instances (%d)", q.MinInstances, q.MaxInstances))
+	}
+	seenZones := make(map[string]bool, len(q.Zones))
+	for _, z := range q.Zones {
+		switch {
+		case z.Zone == "":
+			errs = append(errs, "every zone requires a zone")
+		case seenZones[z.Zone]:
+			errs = append(errs, fmt.Sprintf("zone %s is listed more than once", z.Zone))
+		}
+		seenZones[z.Zone] = true
+
+		if z.Weight < 0 {
+			errs = append(errs, fmt.Sprintf("zone %s: weight must not be negative", z.Zone))
+		}
+	}
+	if q.SpotRatio < 0 || q.SpotRatio > 1 {
+		errs = append(errs, "spot_ratio must be between 0 and 1")
+	}
+	switch q.Placement {
+	case "", PlacementRoundRobin, PlacementLeastLoaded, PlacementWeighted:
+	default:
+		errs = append(errs, fmt.Sprintf("unknown placement %q", q.Placement))
+	}
+	if q.ScaleInHysteresis < 0 {
+		errs = append(errs, "scale_in_hysteresis must not be negative")
+	}
+	if q.IdleTimeout < 0 || q.ScaleInCooldown < 0 || q.ScaleOutCooldown < 0 || q.ZoneFailureCooldown < 0 || q.ProvisioningTimeout < 0 || q.BootTimeout < 0 {
+		errs = append(errs, "durations must not be negative")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(errs, ", "))
+}
+
+// zonesHaveGroups reports whether every zone names its own instance group,
+// so that the queue doesn't need a default one.
+func (q *QueueConfig) zonesHaveGroups() bool {
+	for _, z := range q.Zones {
+		if z.InstanceGroupName == "" {
+			return false
+		}
+	}
+	return len(q.Zones) > 0
+}
@@ -0,0 +1,120 @@
+package scaler
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/buildkite"
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+)
+
+const (
+	// InstanceBooting instances are starting up and have not connected an
+	// agent yet.
+	InstanceBooting = "booting"
+	// InstanceIdle instances have connected agents, none of which are
+	// running a job.
+	InstanceIdle = "idle"
+	// InstanceBusy instances have at least one agent running a job.
+	InstanceBusy = "busy"
+	// InstanceLost instances are running but have had no connected agent
+	// for longer than the queue's BootTimeout.
+	InstanceLost = "lost"
+	// InstanceStopped instances are shutting down, stopped or missing.
+	InstanceStopped = "stopped"
+	// InstanceUnknown is reported when the agents couldn't be listed, for
+	// example because no BuildkiteAPIToken is configured.
+	InstanceUnknown = "unknown"
+
+	DefaultBootTimeout = 10 * time.Minute
+)
+
+// InstanceStatus joins an instance with the agents connected from it.
+type InstanceStatus struct {
+	Instance *gce.Instance      `json:"instance"`
+	Agents   []*buildkite.Agent `json:"agents,omitempty"`
+	State    string             `json:"state"`
+}
+
+// IdleSince returns the time at which the last of the instance's agents
+// became idle.
+func (st *InstanceStatus) IdleSince() time.Time {
+	var since time.Time
+	for _, a := range st.Agents {
+		if a.IdleSince().After(since) {
+			since = a.IdleSince()
+		}
+	}
+	return since
+}
+
+// correlate matches connected agents to instances by hostname and works out
+// what each instance is doing. An instance may run several agents, and is
+// idle only once all of them are. A nil agents slice means the agents are
+// unknown.
+func correlate(instances []*gce.Instance, agents []*buildkite.Agent, bootTimeout time.Duration) []*InstanceStatus {
+	agentsByHost := make(map[string][]*buildkite.Agent, len(agents))
+	for _, a := range agents {
+		if !a.Connected() {
+			continue
+		}
+
+		// Agents may report a fully qualified hostname, while instance names
+		// are the first label.
+		host := strings.SplitN(a.Hostname, ".", 2)[0]
+		agentsByHost[host] = append(agentsByHost[host], a)
+	}
+
+	statuses := make([]*InstanceStatus, 0, len(instances))
+	for _, i := range instances {
+		st := &InstanceStatus{Instance: i, Agents: agentsByHost[i.Name]}
+
+		switch {
+		case !i.Live():
+			st.State = InstanceStopped
+		case agents == nil:
+			st.State = InstanceUnknown
+		case anyBusy(st.Agents):
+			st.State = InstanceBusy
+		case len(st.Agents) > 0:
+			st.State = InstanceIdle
+		case i.Pending() || i.Age() < bootTimeout:
+			st.State = InstanceBooting
+		default:
+			st.State = InstanceLost
+		}
+
+		statuses = append(statuses, st)
+	}
+
+	return statuses
+}
+
+func anyBusy(agents []*buildkite.Agent) bool {
+	for _, a := range agents {
+		if a.Busy() {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceStatuses lists the agents of the organization and correlates them
+// with the given instances of the queue. The agents are unknown when no
+// BuildkiteAPIToken is configured or the organization isn't known.
+func (s *scaler) instanceStatuses(ctx context.Context, q *queue, instances []*gce.Instance, orgSlug string) ([]*InstanceStatus, error) {
+	var agents []*buildkite.Agent
+	if s.cfg.BuildkiteAPIToken != "" && orgSlug != "" {
+		var err error
+		agents, err = s.buildkite.ListAgents(ctx, orgSlug)
+		if err != nil {
+			return nil, err
+		}
+		if agents == nil {
+			agents = []*buildkite.Agent{}
+		}
+	}
+
+	return correlate(instances, agents, q.cfg.BootTimeout), nil
+}
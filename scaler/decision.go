@@ -0,0 +1,159 @@
+package scaler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/buildkite"
+)
+
+const (
+	// DecisionNone means the queue has the instances it needs.
+	DecisionNone = "none"
+	// DecisionLaunch means instances will be launched.
+	DecisionLaunch = "launch"
+	// DecisionScaleIn means up to Count idle instances will be removed.
+	DecisionScaleIn = "scale-in"
+)
+
+// Decision is what a pass would do for a queue given its current jobs and
+// instances.
+type Decision struct {
+	Minimum  int64 `json:"minimum"`
+	Headroom int64 `json:"headroom"`
+	// ExternalAgents are connected agents on the queue that don't run on
+	// the group's instances, such as static machines. They take jobs that
+	// would otherwise need instances.
+	ExternalAgents int64 `json:"external_agents"`
+	// ProfileShortfall is the number of instances profiles need that other
+	// instances can't stand in for. See capacity.ProfileShortfall.
+	ProfileShortfall int64  `json:"profile_shortfall,omitempty"`
+	Desired          int64  `json:"desired"`
+	Live             int64  `json:"live"`
+	InFlight         int64  `json:"in_flight"`
+	Action           string `json:"action"`
+	Count            int64  `json:"count"`
+	// LaunchReason is why instances are launched, one of the LaunchReason
+	// constants.
+	LaunchReason string `json:"launch_reason,omitempty"`
+	// Reason explains why no action is taken despite a difference between
+	// Desired and Live.
+	Reason string `json:"reason,omitempty"`
+}
+
+// decide works out how many instances the queue needs and what to do to get
+// there.
+func (q *queue) decide(metrics *buildkite.AgentMetrics, c *capacity) *Decision {
+	now := time.Now()
+	jobs := metrics.ScheduledJobs + metrics.RunningJobs
+
+	// Schedules are evaluated first, so that warm pools are kept even when
+	// there is no demand.
+	min := q.minInstances(now)
+	headroom := q.headroom(jobs, now)
+
+	// Jobs that external agents are running or can take don't need
+	// instances. Forecasts are still based on every job.
+	external := q.externalAgents(metrics, c)
+	jobs -= external
+	if jobs < 0 {
+		jobs = 0
+	}
+
+	d := &Decision{
+		Minimum:          min,
+		Headroom:         headroom,
+		ExternalAgents:   external,
+		ProfileShortfall: c.ProfileShortfall,
+		Desired:          q.desiredInstanceCount(jobs, headroom, min),
+		Live:             c.Live(),
+		InFlight:         c.InFlight,
+		Action:           DecisionNone,
+	}
+
+	// Instances that were launched but haven't shown up yet will soon be
+	// able to take jobs.
+	live := d.Live + d.InFlight
+
+	// Jobs only a profile can run are already part of the desired count,
+	// but spare instances beyond it can't run them. Count those as missing,
+	// so that the shortfall is launched and the spare instances are scaled
+	// in by a later pass.
+	spare := int64(0)
+	if c.ProfileShortfall > 0 {
+		spare = live - d.Desired + c.ProfileShortfall
+		if spare > c.ProfileShortfall {
+			spare = c.ProfileShortfall
+		}
+		if spare < 0 {
+			spare = 0
+		}
+		d.Desired += spare
+		if q.cfg.MaxInstances > 0 && d.Desired > q.cfg.MaxInstances {
+			d.Desired = q.cfg.MaxInstances
+		}
+	}
+
+	switch {
+	case live > d.Desired:
+		surplus := live - d.Desired
+		if surplus <= q.cfg.ScaleInHysteresis {
+			d.Reason = "surplus within hysteresis"
+			return d
+		}
+		if since := now.Sub(q.lastScaleAction); since < q.cfg.ScaleInCooldown {
+			d.Reason = fmt.Sprintf("scale-in cooldown, %s remaining", (q.cfg.ScaleInCooldown - since).Round(time.Second))
+			return d
+		}
+
+		d.Action = DecisionScaleIn
+		d.Count = surplus
+	case live < d.Desired:
+		if since := now.Sub(q.lastScaleOut); since < q.cfg.ScaleOutCooldown {
+			d.Reason = fmt.Sprintf("scale-out cooldown, %s remaining", (q.cfg.ScaleOutCooldown - since).Round(time.Second))
+			return d
+		}
+
+		d.Action = DecisionLaunch
+		d.Count = d.Desired - live
+		d.LaunchReason = q.launchReason(jobs, headroom, live-spare)
+		if q.cfg.MaxLaunchPerPass > 0 && d.Count > q.cfg.MaxLaunchPerPass {
+			q.logger.Debug("Limiting launches for this pass", "required", d.Count, "limit", q.cfg.MaxLaunchPerPass)
+			d.Count = q.cfg.MaxLaunchPerPass
+		}
+	}
+
+	return d
+}
+
+// launchReason attributes a launch to demand when the current jobs alone need
+// more than live instances, then to forecast headroom, and otherwise to the
+// minimum.
+func (q *queue) launchReason(jobs, headroom, live int64) string {
+	needed := instancesForJobs(jobs, q.cfg.AgentsPerInstance, q.cfg.TargetUtilization)
+	switch {
+	case needed > live:
+		return LaunchReasonDemand
+	case needed+headroom > live:
+		return LaunchReasonForecast
+	default:
+		return LaunchReasonMinimum
+	}
+}
+
+// externalAgents estimates how many of the queue's connected agents don't run
+// on the group's instances, assuming every available instance runs
+// AgentsPerInstance agents. Agents that are still starting on our instances
+// are counted as ours, so the estimate errs towards launching.
+func (q *queue) externalAgents(metrics *buildkite.AgentMetrics, c *capacity) int64 {
+	perInstance := q.cfg.AgentsPerInstance
+	if perInstance < 1 {
+		perInstance = 1
+	}
+
+	external := metrics.TotalAgents - c.Available*perInstance
+	if external < 0 {
+		return 0
+	}
+	return external
+}
@@ -0,0 +1,287 @@
+package scaler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/buildkite"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func TestInstancesForJobs(t *testing.T) {
+	cases := []struct {
+		jobs, agentsPerInstance, utilization int64
+		expected                             int64
+	}{
+		{0, 1, 100, 0},
+		{1, 1, 100, 1},
+		{5, 1, 100, 5},
+		{5, 2, 100, 3},
+		{8, 4, 100, 2},
+		{9, 4, 100, 3},
+		{3, 1, 50, 6},
+		{3, 2, 50, 3},
+		{4, 4, 80, 2},
+		// Unset values are one agent per instance at full utilization.
+		{3, 0, 0, 3},
+		{3, 1, 101, 3},
+	}
+
+	for _, tc := range cases {
+		got := instancesForJobs(tc.jobs, tc.agentsPerInstance, tc.utilization)
+		if got != tc.expected {
+			t.Errorf("instancesForJobs(%d, %d, %d) = %d, expected %d", tc.jobs, tc.agentsPerInstance, tc.utilization, got, tc.expected)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	cases := []struct {
+		name string
+
+		cfg func(*QueueConfig)
+		// sinceScaleAction and sinceScaleOut are how long ago the last
+		// actions were, or never if zero.
+		sinceScaleAction time.Duration
+		sinceScaleOut    time.Duration
+
+		metrics  buildkite.AgentMetrics
+		capacity capacity
+
+		action         string
+		count          int64
+		desired        int64
+		externalAgents int64
+		launchReason   string
+	}{
+		{
+			name:   "no jobs or instances",
+			action: DecisionNone,
+		},
+		{
+			name:         "launches an instance per job",
+			metrics:      buildkite.AgentMetrics{ScheduledJobs: 2, RunningJobs: 1},
+			action:       DecisionLaunch,
+			count:        3,
+			desired:      3,
+			launchReason: LaunchReasonDemand,
+		},
+		{
+			name:         "counts pending instances",
+			metrics:      buildkite.AgentMetrics{ScheduledJobs: 3},
+			capacity:     capacity{Pending: 2},
+			action:       DecisionLaunch,
+			count:        1,
+			desired:      3,
+			launchReason: LaunchReasonDemand,
+		},
+		{
+			name:     "counts in-flight instances",
+			metrics:  buildkite.AgentMetrics{ScheduledJobs: 3},
+			capacity: capacity{InFlight: 3},
+			action:   DecisionNone,
+			desired:  3,
+		},
+		{
+			name:         "packs agents into instances",
+			cfg:          func(qc *QueueConfig) { qc.AgentsPerInstance = 4 },
+			metrics:      buildkite.AgentMetrics{ScheduledJobs: 9},
+			action:       DecisionLaunch,
+			count:        3,
+			desired:      3,
+			launchReason: LaunchReasonDemand,
+		},
+		{
+			name: "keeps spare agents below full utilization",
+			cfg: func(qc *QueueConfig) {
+				qc.AgentsPerInstance = 2
+				qc.TargetUtilization = 50
+			},
+			metrics:      buildkite.AgentMetrics{ScheduledJobs: 3},
+			action:       DecisionLaunch,
+			count:        3,
+			desired:      3,
+			launchReason: LaunchReasonDemand,
+		},
+		{
+			name:         "launches up to the minimum",
+			cfg:          func(qc *QueueConfig) { qc.MinInstances = 2 },
+			action:       DecisionLaunch,
+			count:        2,
+			desired:      2,
+			launchReason: LaunchReasonMinimum,
+		},
+		{
+			name:         "clamps to the maximum",
+			cfg:          func(qc *QueueConfig) { qc.MaxInstances = 2 },
+			metrics:      buildkite.AgentMetrics{ScheduledJobs: 5},
+			action:       DecisionLaunch,
+			count:        2,
+			desired:      2,
+			launchReason: LaunchReasonDemand,
+		},
+		{
+			name:         "limits launches per pass",
+			cfg:          func(qc *QueueConfig) { qc.MaxLaunchPerPass = 2 },
+			metrics:      buildkite.AgentMetrics{ScheduledJobs: 5},
+			action:       DecisionLaunch,
+			count:        2,
+			desired:      5,
+			launchReason: LaunchReasonDemand,
+		},
+		{
+			name:          "waits for the scale-out cooldown",
+			cfg:           func(qc *QueueConfig) { qc.ScaleOutCooldown = 5 * time.Minute },
+			sinceScaleOut: time.Minute,
+			metrics:       buildkite.AgentMetrics{ScheduledJobs: 3},
+			action:        DecisionNone,
+			desired:       3,
+		},
+		{
+			name:          "launches after the scale-out cooldown",
+			cfg:           func(qc *QueueConfig) { qc.ScaleOutCooldown = 5 * time.Minute },
+			sinceScaleOut: 10 * time.Minute,
+			metrics:       buildkite.AgentMetrics{ScheduledJobs: 3},
+			action:        DecisionLaunch,
+			count:         3,
+			desired:       3,
+			launchReason:  LaunchReasonDemand,
+		},
+		{
+			name:     "scales in the surplus",
+			metrics:  buildkite.AgentMetrics{RunningJobs: 1},
+			capacity: capacity{Available: 3},
+			action:   DecisionScaleIn,
+			count:    2,
+			desired:  1,
+		},
+		{
+			name:     "tolerates a surplus within hysteresis",
+			cfg:      func(qc *QueueConfig) { qc.ScaleInHysteresis = 2 },
+			metrics:  buildkite.AgentMetrics{RunningJobs: 1},
+			capacity: capacity{Available: 3},
+			action:   DecisionNone,
+			desired:  1,
+		},
+		{
+			name:     "scales in a surplus beyond hysteresis",
+			cfg:      func(qc *QueueConfig) { qc.ScaleInHysteresis = 1 },
+			metrics:  buildkite.AgentMetrics{RunningJobs: 1},
+			capacity: capacity{Available: 4},
+			action:   DecisionScaleIn,
+			count:    3,
+			desired:  1,
+		},
+		{
+			name:             "waits for the scale-in cooldown",
+			sinceScaleAction: time.Minute,
+			capacity:         capacity{Available: 2},
+			action:           DecisionNone,
+		},
+		{
+			name:     "doesn't scale in draining instances",
+			capacity: capacity{Draining: 2},
+			action:   DecisionNone,
+		},
+		{
+			name:           "discounts jobs external agents can take",
+			metrics:        buildkite.AgentMetrics{ScheduledJobs: 4, IdleAgents: 3, TotalAgents: 3},
+			action:         DecisionLaunch,
+			count:          1,
+			desired:        1,
+			externalAgents: 3,
+			launchReason:   LaunchReasonDemand,
+		},
+		{
+			name:           "doesn't count our agents as external",
+			cfg:            func(qc *QueueConfig) { qc.AgentsPerInstance = 2 },
+			metrics:        buildkite.AgentMetrics{ScheduledJobs: 6, RunningJobs: 4, BusyAgents: 5, TotalAgents: 5},
+			capacity:       capacity{Available: 2},
+			action:         DecisionLaunch,
+			count:          3,
+			desired:        5,
+			externalAgents: 1,
+			launchReason:   LaunchReasonDemand,
+		},
+		{
+			name:     "scales in when external agents take the work",
+			metrics:  buildkite.AgentMetrics{ScheduledJobs: 2, IdleAgents: 4, TotalAgents: 4},
+			capacity: capacity{Available: 2},
+			action:   DecisionScaleIn,
+			count:    2,
+			// Two of the four agents run on our instances.
+			externalAgents: 2,
+		},
+		{
+			name:         "launches a profile shortfall",
+			metrics:      buildkite.AgentMetrics{ScheduledJobs: 3},
+			capacity:     capacity{ProfileShortfall: 3},
+			action:       DecisionLaunch,
+			count:        3,
+			desired:      3,
+			launchReason: LaunchReasonDemand,
+		},
+		{
+			name:         "launches a profile shortfall despite spare instances",
+			metrics:      buildkite.AgentMetrics{ScheduledJobs: 3},
+			capacity:     capacity{Available: 3, ProfileShortfall: 3},
+			action:       DecisionLaunch,
+			count:        3,
+			desired:      6,
+			launchReason: LaunchReasonDemand,
+		},
+		{
+			name:         "counts only spare instances against a profile shortfall",
+			metrics:      buildkite.AgentMetrics{ScheduledJobs: 3},
+			capacity:     capacity{Available: 1, ProfileShortfall: 3},
+			action:       DecisionLaunch,
+			count:        3,
+			desired:      4,
+			launchReason: LaunchReasonDemand,
+		},
+		{
+			name:         "clamps a profile shortfall to the maximum",
+			cfg:          func(qc *QueueConfig) { qc.MaxInstances = 4 },
+			metrics:      buildkite.AgentMetrics{ScheduledJobs: 3},
+			capacity:     capacity{Available: 3, ProfileShortfall: 3},
+			action:       DecisionLaunch,
+			count:        1,
+			desired:      4,
+			launchReason: LaunchReasonDemand,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			qc := DefaultQueueConfig()
+			qc.BuildkiteQueue = "default"
+			if tc.cfg != nil {
+				tc.cfg(qc)
+			}
+
+			q := &queue{cfg: qc, logger: hclog.NewNullLogger()}
+			if tc.sinceScaleAction > 0 {
+				q.lastScaleAction = time.Now().Add(-tc.sinceScaleAction)
+			}
+			if tc.sinceScaleOut > 0 {
+				q.lastScaleOut = time.Now().Add(-tc.sinceScaleOut)
+			}
+
+			metrics, c := tc.metrics, tc.capacity
+			d := q.decide(&metrics, &c)
+
+			if d.Action != tc.action || d.Count != tc.count {
+				t.Errorf("decided %s %d (%s), expected %s %d", d.Action, d.Count, d.Reason, tc.action, tc.count)
+			}
+			if d.Desired != tc.desired {
+				t.Errorf("desired %d, expected %d", d.Desired, tc.desired)
+			}
+			if d.ExternalAgents != tc.externalAgents {
+				t.Errorf("external agents %d, expected %d", d.ExternalAgents, tc.externalAgents)
+			}
+			if d.LaunchReason != tc.launchReason {
+				t.Errorf("launch reason %q, expected %q", d.LaunchReason, tc.launchReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package scaler
+
+import (
+	"context"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// dryRunGCE passes reads through to the GCE client but only logs the
+// instances it would launch, delete or resize.
+type dryRunGCE struct {
+	*gce.Client
+
+	logger hclog.Logger
+}
+
+func (d *dryRunGCE) LaunchInstanceForGroup(ctx context.Context, projectID, zone, groupName, templateName string, opts *gce.LaunchOptions) error {
+	name := ""
+	if opts != nil {
+		name = opts.Name
+	}
+	if name == "" {
+		var err error
+		if name, err = gce.InstanceName(templateName); err != nil {
+			return err
+		}
+	}
+
+	d.logger.Info("Would launch instance", "name", name, "zone", zone, "group", groupName, "template", templateName)
+	return nil
+}
+
+func (d *dryRunGCE) DeleteInstance(ctx context.Context, projectID, zone, name string) error {
+	d.logger.Info("Would delete instance", "name", name, "zone", zone)
+	return nil
+}
+
+func (d *dryRunGCE) RemoveInstancesFromGroup(ctx context.Context, projectID, zone, groupName string, instances []*gce.Instance) error {
+	for _, i := range instances {
+		d.logger.Info("Would remove instance from group", "name", i.Name, "zone", zone, "group", groupName)
+	}
+	return nil
+}
+
+func (d *dryRunGCE) ResizeManagedGroup(ctx context.Context, g *gce.ManagedGroup, size int64) error {
+	d.logger.Info("Would resize managed instance group", "group", g.String(), "size", size)
+	return nil
+}
+
+func (d *dryRunGCE) DeleteManagedInstances(ctx context.Context, g *gce.ManagedGroup, instances []*gce.Instance) error {
+	for _, i := range instances {
+		d.logger.Info("Would delete managed instance", "name", i.Name, "group", g.String())
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package scaler
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// ForecastEWMA forecasts demand as an exponentially weighted moving
+	// average of recent samples, which keeps capacity around after bursts.
+	ForecastEWMA = "ewma"
+	// ForecastLastWeek forecasts demand as the peak seen at the same time a
+	// week ago, looking ahead by Lookahead, which anticipates weekly
+	// patterns.
+	ForecastLastWeek = "last-week"
+
+	DefaultForecastAlpha     = 0.3
+	DefaultForecastLookahead = 15 * time.Minute
+)
+
+// ForecastConfig adds headroom on top of a queue's current demand based on
+// its recent history.
+type ForecastConfig struct {
+	// Model is ForecastEWMA or ForecastLastWeek.
+	Model string `yaml:"model"`
+	// Alpha is the weight of the newest sample for ForecastEWMA.
+	Alpha float64 `yaml:"alpha"`
+	// Lookahead is how far past the same time last week ForecastLastWeek
+	// looks for peaks.
+	Lookahead time.Duration `yaml:"lookahead"`
+	// MaxHeadroom caps the number of instances added by the forecast. Zero
+	// means unlimited.
+	MaxHeadroom int64 `yaml:"max_headroom"`
+}
+
+// UnmarshalYAML applies the defaults to any setting that is not present in
+// the file.
+func (f *ForecastConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ForecastConfig
+	*f = ForecastConfig{
+		Alpha:     DefaultForecastAlpha,
+		Lookahead: DefaultForecastLookahead,
+	}
+	return unmarshal((*plain)(f))
+}
+
+func (f *ForecastConfig) validate() error {
+	switch f.Model {
+	case ForecastEWMA, ForecastLastWeek:
+	default:
+		return fmt.Errorf("unknown forecast model %q", f.Model)
+	}
+	if f.Alpha <= 0 || f.Alpha > 1 {
+		return fmt.Errorf("forecast alpha must be greater than 0 and at most 1")
+	}
+	if f.Lookahead < 0 || f.MaxHeadroom < 0 {
+		return fmt.Errorf("forecast lookahead and max_headroom must not be negative")
+	}
+	return nil
+}
+
+// forecastJobs returns the number of jobs the queue's forecast expects, or
+// zero if the queue has no forecast or not enough history.
+func (q *queue) forecastJobs(now time.Time) int64 {
+	f := q.cfg.Forecast
+	if f == nil || q.history == nil {
+		return 0
+	}
+
+	switch f.Model {
+	case ForecastEWMA:
+		if q.history.EWMA == nil {
+			return 0
+		}
+		return int64(math.Ceil(*q.history.EWMA))
+	case ForecastLastWeek:
+		// Samples are kept per minute, so the window starts on a minute too.
+		from := now.Add(-7 * 24 * time.Hour).Truncate(time.Minute)
+		to := from.Add(f.Lookahead)
+
+		peak := int64(0)
+		for _, s := range q.history.Samples {
+			if !s.Time.Before(from) && !s.Time.After(to) && s.jobs() > peak {
+				peak = s.jobs()
+			}
+		}
+		return peak
+	}
+
+	return 0
+}
+
+// headroom returns the number of instances to add on top of those needed for
+// the current jobs so that the forecast demand can be met, up to the
+// forecast's MaxHeadroom.
+func (q *queue) headroom(jobs int64, now time.Time) int64 {
+	forecast := q.forecastJobs(now)
+	if forecast <= jobs {
+		return 0
+	}
+
+	extra := instancesForJobs(forecast, q.cfg.AgentsPerInstance, q.cfg.TargetUtilization) -
+		instancesForJobs(jobs, q.cfg.AgentsPerInstance, q.cfg.TargetUtilization)
+	if max := q.cfg.Forecast.MaxHeadroom; max > 0 && extra > max {
+		extra = max
+	}
+
+	if extra > 0 {
+		q.logger.Debug("Adding forecast headroom", "model", q.cfg.Forecast.Model, "jobs", jobs, "forecast", forecast, "headroom", extra)
+	}
+	return extra
+}
@@ -0,0 +1,141 @@
+package scaler
+
+import (
+	"context"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+)
+
+const (
+	// GroupTypeUnmanaged creates instances from a template and adds them to
+	// an unmanaged instance group.
+	GroupTypeUnmanaged = "unmanaged"
+	// GroupTypeManaged resizes a zonal or regional managed instance group.
+	GroupTypeManaged = "managed"
+)
+
+// group adds and removes the instances that run a queue's jobs.
+type group interface {
+	// Instances lists the current members of the group.
+	Instances(ctx context.Context) ([]*gce.Instance, error)
+	// Launch adds count instances to the group for the given LaunchReason,
+	// from the profile's template or the queue's own if it's nil, returning
+	// the number that were launched successfully.
+	Launch(ctx context.Context, count int64, reason string, profile *ProfileConfig) (int64, error)
+	// Delete removes instances from the group and deletes them, returning
+	// the number that were deleted successfully.
+	Delete(ctx context.Context, instances []*gce.Instance) (int64, error)
+	// Reap cleans up members that will never run a job, returning the
+	// number that were cleaned up.
+	Reap(ctx context.Context) (int64, error)
+}
+
+func newGroup(s *scaler, q *queue) group {
+	if q.cfg.InstanceGroupType == GroupTypeManaged {
+		return &managedGroup{
+			s: s,
+			group: &gce.ManagedGroup{
+				Project: s.cfg.GCPProject,
+				Zone:    q.cfg.GCPZone,
+				Region:  q.cfg.GCPRegion,
+				Name:    q.cfg.InstanceGroupName,
+			},
+		}
+	}
+
+	if len(q.cfg.Zones) > 0 {
+		return newMultiZoneGroup(s, q)
+	}
+
+	return &unmanagedGroup{s: s, q: q, zone: q.cfg.GCPZone, name: q.cfg.InstanceGroupName}
+}
+
+// unmanagedGroup creates each instance individually and adds it to an
+// unmanaged instance group.
+type unmanagedGroup struct {
+	s    *scaler
+	q    *queue
+	zone string
+	name string
+}
+
+func (g *unmanagedGroup) Instances(ctx context.Context) ([]*gce.Instance, error) {
+	return g.s.gce.ListGroupInstances(ctx, g.s.cfg.GCPProject, g.zone, g.name)
+}
+
+func (g *unmanagedGroup) Launch(ctx context.Context, count int64, reason string, profile *ProfileConfig) (int64, error) {
+	return g.s.launchInstances(ctx, g.q, g.zone, g.name, count, reason, profile)
+}
+
+func (g *unmanagedGroup) Delete(ctx context.Context, instances []*gce.Instance) (int64, error) {
+	deleted := int64(0)
+	for _, i := range instances {
+		if err := g.s.gce.DeleteInstance(ctx, g.s.cfg.GCPProject, g.zone, i.Name); err != nil {
+			return deleted, err
+		}
+		g.s.revokeAgentToken(ctx, i.Name, "instance deleted")
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// managedGroup delegates instance creation to a managed instance group by
+// changing its target size.
+type managedGroup struct {
+	s     *scaler
+	group *gce.ManagedGroup
+}
+
+func (g *managedGroup) Instances(ctx context.Context) ([]*gce.Instance, error) {
+	return g.s.gce.ListManagedInstances(ctx, g.group)
+}
+
+// Launch resizes the group to its live members plus count. The target size
+// isn't used, since it disagrees with the members while they are being
+// abandoned or recreated.
+func (g *managedGroup) Launch(ctx context.Context, count int64, reason string, profile *ProfileConfig) (int64, error) {
+	members, err := g.Instances(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	live := int64(0)
+	for _, i := range members {
+		if i.Live() {
+			live++
+		}
+	}
+
+	// Never resize below the members, which would have the group delete
+	// instances of its own choosing.
+	size := live + count
+	if size <= int64(len(members)) {
+		g.s.logger.Debug("Not resizing managed group, members are being recreated", "group", g.group.String(), "members", len(members), "live", live, "count", count)
+		return 0, nil
+	}
+
+	if err := g.s.gce.ResizeManagedGroup(ctx, g.group, size); err != nil {
+		return 0, err
+	}
+
+	return size - int64(len(members)), nil
+}
+
+// Reap does nothing for managed groups, which recreate unhealthy members and
+// drop deleted ones themselves.
+func (g *managedGroup) Reap(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (g *managedGroup) Delete(ctx context.Context, instances []*gce.Instance) (int64, error) {
+	if len(instances) == 0 {
+		return 0, nil
+	}
+
+	if err := g.s.gce.DeleteManagedInstances(ctx, g.group, instances); err != nil {
+		return 0, err
+	}
+
+	return int64(len(instances)), nil
+}
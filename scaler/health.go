@@ -0,0 +1,106 @@
+package scaler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUnhealthyAfterFailures = 3
+	DefaultStaleAfterIntervals    = 3
+)
+
+// Health describes the outcome of recent passes.
+type Health struct {
+	StartedAt           time.Time  `json:"started_at"`
+	LastPassAt          *time.Time `json:"last_pass_at,omitempty"`
+	LastSuccessAt       *time.Time `json:"last_success_at,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+
+	// Ready is false once too many passes have failed in a row, or when no
+	// pass has completed for too long. Reason explains why.
+	Ready  bool   `json:"ready"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// healthTracker records the result of each pass for reporting over HTTP.
+type healthTracker struct {
+	sync.Mutex
+
+	startedAt           time.Time
+	lastPassAt          time.Time
+	lastSuccessAt       time.Time
+	lastError           error
+	consecutiveFailures int
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{startedAt: time.Now()}
+}
+
+func (h *healthTracker) record(err error) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.lastPassAt = time.Now()
+	h.lastError = err
+	if err != nil {
+		h.consecutiveFailures++
+	} else {
+		h.consecutiveFailures = 0
+		h.lastSuccessAt = h.lastPassAt
+	}
+}
+
+func (h *healthTracker) health(cfg *Config) *Health {
+	h.Lock()
+	defer h.Unlock()
+
+	health := &Health{
+		StartedAt:           h.startedAt,
+		ConsecutiveFailures: h.consecutiveFailures,
+		Ready:               true,
+	}
+	if !h.lastPassAt.IsZero() {
+		t := h.lastPassAt
+		health.LastPassAt = &t
+	}
+	if !h.lastSuccessAt.IsZero() {
+		t := h.lastSuccessAt
+		health.LastSuccessAt = &t
+	}
+	if h.lastError != nil {
+		health.LastError = h.lastError.Error()
+	}
+
+	threshold := cfg.UnhealthyAfterFailures
+	if threshold <= 0 {
+		threshold = DefaultUnhealthyAfterFailures
+	}
+	if h.consecutiveFailures >= threshold {
+		health.Ready = false
+		health.Reason = fmt.Sprintf("%d consecutive passes failed", h.consecutiveFailures)
+		return health
+	}
+
+	if cfg.PollInterval != nil {
+		intervals := cfg.StaleAfterIntervals
+		if intervals <= 0 {
+			intervals = DefaultStaleAfterIntervals
+		}
+
+		since := h.startedAt
+		if !h.lastPassAt.IsZero() {
+			since = h.lastPassAt
+		}
+
+		if limit := time.Duration(intervals) * *cfg.PollInterval; time.Since(since) > limit {
+			health.Ready = false
+			health.Reason = fmt.Sprintf("no pass completed in %s", limit)
+		}
+	}
+
+	return health
+}
@@ -0,0 +1,131 @@
+package scaler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// historySaveInterval is the minimum time between writes of
+// Config.HistoryFile while the scaler is running.
+const historySaveInterval = 5 * time.Minute
+
+// sample is a queue's demand at the start of a pass.
+type sample struct {
+	Time      time.Time `json:"time"`
+	Scheduled int64     `json:"scheduled"`
+	Running   int64     `json:"running"`
+}
+
+func (s *sample) jobs() int64 {
+	return s.Scheduled + s.Running
+}
+
+// history is what a single queue's forecast needs to remember. ForecastEWMA
+// only keeps the running average, while ForecastLastWeek keeps the peak of
+// every minute for a week and its lookahead, oldest first.
+type history struct {
+	EWMA    *float64  `json:"ewma,omitempty"`
+	Samples []*sample `json:"samples,omitempty"`
+}
+
+func (h *history) add(f *ForecastConfig, s *sample) {
+	switch f.Model {
+	case ForecastEWMA:
+		avg := float64(s.jobs())
+		if h.EWMA != nil {
+			avg = f.Alpha*avg + (1-f.Alpha)*(*h.EWMA)
+		}
+		h.EWMA = &avg
+		h.Samples = nil
+	case ForecastLastWeek:
+		s.Time = s.Time.Truncate(time.Minute)
+		if n := len(h.Samples); n > 0 && h.Samples[n-1].Time.Equal(s.Time) {
+			if s.jobs() > h.Samples[n-1].jobs() {
+				h.Samples[n-1] = s
+			}
+		} else {
+			h.Samples = append(h.Samples, s)
+		}
+
+		cutoff := s.Time.Add(-(7*24*time.Hour + f.Lookahead))
+		i := 0
+		for i < len(h.Samples) && h.Samples[i].Time.Before(cutoff) {
+			i++
+		}
+		h.Samples = h.Samples[i:]
+		h.EWMA = nil
+	}
+}
+
+// loadHistory reads the history of every queue from path, keyed by queue
+// name. A missing file yields an empty history.
+func loadHistory(path string) (map[string]*history, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var histories map[string]*history
+	return histories, json.Unmarshal(data, &histories)
+}
+
+// maybeSaveHistory saves the history if Config.HistoryFile is set and it
+// hasn't been saved within historySaveInterval, or unconditionally if force
+// is set.
+func (s *scaler) maybeSaveHistory(force bool) {
+	if s.cfg.HistoryFile == "" {
+		return
+	}
+	if !force && time.Since(s.historySaved) < historySaveInterval {
+		return
+	}
+
+	if err := s.saveHistory(); err != nil {
+		s.logger.Warn("Failed to save history", "path", s.cfg.HistoryFile, "error", err)
+		return
+	}
+	s.historySaved = time.Now()
+}
+
+// saveHistory writes the history of every queue that keeps one to
+// Config.HistoryFile. The file is written to a temporary file first and
+// renamed into place, so that a crash can't leave it truncated.
+func (s *scaler) saveHistory() error {
+	histories := make(map[string]*history)
+	for _, q := range s.queues {
+		if q.history != nil {
+			histories[q.cfg.BuildkiteQueue] = q.history
+		}
+	}
+
+	data, err := json.Marshal(histories)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.cfg.HistoryFile), ".history")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.cfg.HistoryFile)
+}
@@ -0,0 +1,54 @@
+package scaler
+
+import (
+	"time"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+)
+
+// recordLaunch remembers an instance launched into an unmanaged group. The
+// launch has completed by then, but a listing of the group may lag behind
+// it, and later passes shouldn't launch the instance again in the meantime.
+func (q *queue) recordLaunch(name string, at time.Time) {
+	q.launchesMu.Lock()
+	defer q.launchesMu.Unlock()
+
+	if q.launches == nil {
+		q.launches = make(map[string]time.Time)
+	}
+	q.launches[name] = at
+}
+
+// sawInstances forgets the launches of instances that have been seen in the
+// group. Once seen, an instance counts as capacity for as long as it is
+// listed, and no longer once it has terminated or been deleted.
+func (q *queue) sawInstances(instances []*gce.Instance) {
+	q.launchesMu.Lock()
+	defer q.launchesMu.Unlock()
+
+	for _, i := range instances {
+		delete(q.launches, i.Name)
+	}
+}
+
+// inFlight returns the number of instances this scaler launched that haven't
+// been listed in the group yet. Launches are forgotten once they are older than
+// ProvisioningTimeout, since by then they'd be reaped as stuck.
+func (q *queue) inFlight(instances []*gce.Instance, now time.Time) int64 {
+	q.sawInstances(instances)
+
+	timeout := q.cfg.ProvisioningTimeout
+	if timeout <= 0 {
+		timeout = DefaultProvisioningTimeout
+	}
+
+	q.launchesMu.Lock()
+	defer q.launchesMu.Unlock()
+
+	for name, at := range q.launches {
+		if now.Sub(at) > timeout {
+			delete(q.launches, name)
+		}
+	}
+	return int64(len(q.launches))
+}
@@ -0,0 +1,124 @@
+package scaler
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+)
+
+// Labels and metadata set on every instance launched into an unmanaged
+// group, so that instances can be attributed to a queue and a scaler.
+const (
+	LabelQueue        = "buildkite-queue"
+	LabelScaler       = "buildkite-gcp-scaler"
+	LabelLaunchedAt   = "buildkite-launched-at"
+	LabelLaunchReason = "buildkite-launch-reason"
+	LabelProfile      = "buildkite-profile"
+
+	// MetadataAgentTags holds the queue's agent tags as a comma separated
+	// list of key=value pairs, suitable for BUILDKITE_AGENT_TAGS.
+	MetadataAgentTags = "buildkite-agent-tags"
+)
+
+const (
+	// LaunchReasonDemand instances run scheduled or running jobs.
+	LaunchReasonDemand = "demand"
+	// LaunchReasonForecast instances are headroom for forecast demand.
+	LaunchReasonForecast = "forecast"
+	// LaunchReasonMinimum instances keep the queue at its minimum, which
+	// may be raised by a schedule.
+	LaunchReasonMinimum = "minimum"
+)
+
+var (
+	labelKeyRegexp   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValueRegexp = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+
+	invalidLabelCharsRegexp = regexp.MustCompile(`[^a-z0-9_-]`)
+)
+
+// labelValue converts s into a valid label value.
+func labelValue(s string) string {
+	v := invalidLabelCharsRegexp.ReplaceAllString(strings.ToLower(s), "-")
+	if len(v) > 63 {
+		v = v[:63]
+	}
+	return v
+}
+
+// defaultScalerID identifies this scaler by the host it runs on.
+func defaultScalerID() string {
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return "buildkite-gcp-scaler"
+}
+
+// launchOptions returns the labels and metadata for an instance of the queue
+// and profile, which may be nil, launched for the given reason. The queue's
+// own labels and metadata can't override the ones the scaler sets.
+func (s *scaler) launchOptions(q *queue, profile *ProfileConfig, reason string) *gce.LaunchOptions {
+	now := time.Now()
+
+	labels := make(map[string]string, len(q.cfg.Labels)+4)
+	for k, v := range q.cfg.Labels {
+		labels[k] = v
+	}
+	labels[LabelQueue] = labelValue(q.cfg.BuildkiteQueue)
+	labels[LabelScaler] = labelValue(s.cfg.ScalerID)
+	labels[LabelLaunchedAt] = strconv.FormatInt(now.Unix(), 10)
+	labels[LabelLaunchReason] = reason
+	if profile != nil {
+		labels[LabelProfile] = labelValue(profile.Name)
+	}
+
+	metadata := make(map[string]string, len(q.cfg.Metadata)+5)
+	for k, v := range q.cfg.Metadata {
+		metadata[k] = v
+	}
+	metadata[LabelQueue] = q.cfg.BuildkiteQueue
+	metadata[LabelScaler] = s.cfg.ScalerID
+	metadata[LabelLaunchedAt] = now.UTC().Format(time.RFC3339)
+	metadata[LabelLaunchReason] = reason
+	metadata[MetadataAgentTags] = agentTags(q.cfg, profile)
+	if profile != nil {
+		metadata[LabelProfile] = profile.Name
+	}
+
+	return &gce.LaunchOptions{Labels: labels, Metadata: metadata}
+}
+
+// agentTags returns the agent tags of the queue and profile, which may be
+// nil, as sorted key=value pairs for stable output.
+func agentTags(qc *QueueConfig, profile *ProfileConfig) string {
+	merged := agentTagMap(qc, profile)
+
+	tags := make([]string, 0, len(merged))
+	for k, v := range merged {
+		tags = append(tags, k+"="+v)
+	}
+
+	sort.Strings(tags)
+	return strings.Join(tags, ",")
+}
+
+// agentTagMap returns the tags the agents of the queue and profile, which may
+// be nil, register with, including the queue unless that is given
+// explicitly. The profile's tags take precedence.
+func agentTagMap(qc *QueueConfig, profile *ProfileConfig) map[string]string {
+	merged := map[string]string{"queue": qc.BuildkiteQueue}
+	for k, v := range qc.AgentTags {
+		merged[k] = v
+	}
+	if profile != nil {
+		for k, v := range profile.AgentTags {
+			merged[k] = v
+		}
+	}
+	return merged
+}
@@ -0,0 +1,170 @@
+package scaler
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// DefaultLaunchConcurrency is used when Config.LaunchConcurrency is unset.
+const DefaultLaunchConcurrency = 10
+
+// launchInstances launches count instances for the queue into an unmanaged
+// group using a bounded pool of workers, from the profile's template if it's
+// set. Every launch is attempted even if some fail; the number of successful
+// launches is returned along with the aggregated errors.
+func (s *scaler) launchInstances(ctx context.Context, q *queue, zone, groupName string, count int64, reason string, profile *ProfileConfig) (int64, error) {
+	concurrency := s.cfg.LaunchConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultLaunchConcurrency
+	}
+	if int64(concurrency) > count {
+		concurrency = int(count)
+	}
+
+	// Spot templates are only configured for the queue's own template.
+	template, spot := q.cfg.InstanceGroupTemplate, int64(0)
+	if profile != nil {
+		template = profile.InstanceTemplate
+	} else {
+		var err error
+		spot, err = s.spotLaunchCount(ctx, q, zone, groupName, count)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	q.logger.Debug("Launching instances", "zone", zone, "count", count, "template", template, "spot", spot, "reason", reason, "concurrency", concurrency)
+
+	work := make(chan string)
+	go func() {
+		defer close(work)
+		for i := int64(0); i < count; i++ {
+			if i < spot {
+				work <- q.cfg.SpotInstanceTemplate
+			} else {
+				work <- template
+			}
+		}
+	}()
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int64
+		result    error
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for template := range work {
+				err := s.launchInstance(ctx, q, zone, groupName, template, reason, profile)
+
+				mu.Lock()
+				if err != nil {
+					result = multierror.Append(result, err)
+				} else {
+					succeeded++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return succeeded, result
+}
+
+// launchInstance launches a single instance from the given template. Spot
+// launches that fail for lack of capacity are retried on-demand.
+func (s *scaler) launchInstance(ctx context.Context, q *queue, zone, groupName, template, reason string, profile *ProfileConfig) error {
+	err := s.launchFromTemplate(ctx, q, zone, groupName, template, reason, profile)
+	if err == nil || template != q.cfg.SpotInstanceTemplate || !gce.IsCapacityError(err) {
+		return err
+	}
+
+	q.logger.Warn("Spot capacity unavailable, launching on-demand instead", "zone", zone, "error", err)
+	spotFallbacksCounter.WithLabelValues(q.cfg.BuildkiteQueue).Inc()
+
+	return s.launchFromTemplate(ctx, q, zone, groupName, q.cfg.InstanceGroupTemplate, reason, profile)
+}
+
+// launchFromTemplate launches a single instance, labelled with the queue,
+// scaler and reason, and records it as in-flight. With DynamicAgentTokens, a
+// registration token is created for it first and passed to it through its
+// metadata.
+func (s *scaler) launchFromTemplate(ctx context.Context, q *queue, zone, groupName, template, reason string, profile *ProfileConfig) error {
+	name, err := gce.InstanceName(template)
+	if err != nil {
+		return err
+	}
+
+	opts := s.launchOptions(q, profile, reason)
+	opts.Name = name
+
+	if s.cfg.DynamicAgentTokens {
+		token, err := s.createAgentToken(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		key := s.cfg.AgentTokenMetadataKey
+		if key == "" {
+			key = DefaultAgentTokenMetadataKey
+		}
+		opts.Metadata[key] = token
+	}
+
+	if err := s.gce.LaunchInstanceForGroup(ctx, s.cfg.GCPProject, zone, groupName, template, opts); err != nil {
+		if s.cfg.DynamicAgentTokens {
+			// Revoke with a fresh context so that cancelling the pass
+			// doesn't leave the token behind.
+			s.revokeAgentToken(context.Background(), name, "launch failed")
+		}
+		return err
+	}
+
+	// Pretend launches never show up, so mustn't be waited for.
+	if !s.cfg.DryRun {
+		q.recordLaunch(name, time.Now())
+	}
+	return nil
+}
+
+// spotLaunchCount returns how many of count launches should use the spot
+// template so that the group approaches the queue's SpotRatio.
+func (s *scaler) spotLaunchCount(ctx context.Context, q *queue, zone, groupName string, count int64) (int64, error) {
+	if q.cfg.SpotInstanceTemplate == "" {
+		return 0, nil
+	}
+
+	instances, err := s.gce.ListGroupInstances(ctx, s.cfg.GCPProject, zone, groupName)
+	if err != nil {
+		return 0, err
+	}
+
+	live, spot := int64(0), int64(0)
+	for _, i := range instances {
+		if !i.Live() {
+			continue
+		}
+		live++
+		if i.FromTemplate(q.cfg.SpotInstanceTemplate) {
+			spot++
+		}
+	}
+
+	target := int64(math.Floor(q.cfg.SpotRatio*float64(live+count)+0.5)) - spot
+	if target < 0 {
+		return 0, nil
+	}
+	if target > count {
+		return count, nil
+	}
+	return target, nil
+}
@@ -0,0 +1,119 @@
+package scaler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "buildkite_gcp_scaler"
+
+var (
+	scheduledJobsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "scheduled_jobs",
+		Help:      "Number of jobs waiting to be run on the queue.",
+	}, []string{"queue"})
+
+	runningJobsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "running_jobs",
+		Help:      "Number of jobs running on the queue.",
+	}, []string{"queue"})
+
+	waitingJobsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "waiting_jobs",
+		Help:      "Number of jobs on the queue blocked on other jobs or concurrency limits.",
+	}, []string{"queue"})
+
+	agentsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "agents",
+		Help:      "Number of connected agents on the queue by state: idle or busy.",
+	}, []string{"queue", "state"})
+
+	externalAgentsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "external_agents",
+		Help:      "Estimated number of connected agents on the queue that don't run on its instance group.",
+	}, []string{"queue"})
+
+	liveInstancesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "live_instances",
+		Help:      "Number of pending or available instances in the queue's group.",
+	}, []string{"queue"})
+
+	instancesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "instances",
+		Help:      "Number of instances in the queue's group that are pending, available or draining.",
+	}, []string{"queue", "state"})
+
+	desiredInstancesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "desired_instances",
+		Help:      "Number of instances the scaler wants for the queue.",
+	}, []string{"queue"})
+
+	launchesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "launches_total",
+		Help:      "Number of instance launches attempted.",
+	}, []string{"queue"})
+
+	launchFailuresCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "launch_failures_total",
+		Help:      "Number of instance launches that failed.",
+	}, []string{"queue"})
+
+	spotFallbacksCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "spot_fallbacks_total",
+		Help:      "Number of spot launches retried with the on-demand template.",
+	}, []string{"queue"})
+
+	deletionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "deletions_total",
+		Help:      "Number of idle instances deleted.",
+	}, []string{"queue"})
+
+	agentTokensCreatedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_tokens_created_total",
+		Help:      "Number of agent registration tokens created for instances.",
+	})
+
+	agentTokensRevokedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_tokens_revoked_total",
+		Help:      "Number of agent registration tokens revoked.",
+	}, []string{"reason"})
+
+	reapedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reaped_instances_total",
+		Help:      "Number of terminated, stuck or missing instances cleaned up.",
+	}, []string{"queue", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		scheduledJobsGauge,
+		runningJobsGauge,
+		waitingJobsGauge,
+		agentsGauge,
+		externalAgentsGauge,
+		liveInstancesGauge,
+		instancesGauge,
+		desiredInstancesGauge,
+		launchesCounter,
+		launchFailuresCounter,
+		spotFallbacksCounter,
+		deletionsCounter,
+		reapedCounter,
+		agentTokensCreatedCounter,
+		agentTokensRevokedCounter,
+	)
+}
@@ -0,0 +1,155 @@
+package scaler
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/buildkite"
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+)
+
+// ProfileConfig is an alternative instance template for a queue, used for
+// jobs whose agent query rules its AgentTags satisfy but the queue's own
+// don't, e.g. jobs targeting size=large or arch=arm64.
+type ProfileConfig struct {
+	Name             string `yaml:"name"`
+	InstanceTemplate string `yaml:"instance_template"`
+	// AgentTags are the tags the profile's agents register with, in addition
+	// to the queue's. They are passed to instances like the queue's own.
+	AgentTags map[string]string `yaml:"agent_tags"`
+}
+
+// matches reports whether an agent from the profile in the queue could run a
+// job with the given agent query rules.
+func (p *ProfileConfig) matches(qc *QueueConfig, rules []string) bool {
+	return rulesMatch(agentTagMap(qc, p), rules)
+}
+
+// rulesMatch reports whether an agent with the given tags could run a job
+// with the given agent query rules. Rules are key=value or key!=value, where
+// the value may use * as a wildcard.
+func rulesMatch(tags map[string]string, rules []string) bool {
+	for _, rule := range rules {
+		negate := false
+		i := strings.Index(rule, "=")
+		if i < 0 {
+			return false
+		}
+		key, pattern := rule[:i], rule[i+1:]
+		if strings.HasSuffix(key, "!") {
+			negate = true
+			key = strings.TrimSuffix(key, "!")
+		}
+
+		value, ok := tags[key]
+		matched := false
+		if ok {
+			matched, _ = path.Match(pattern, value)
+		}
+		if matched == negate {
+			return false
+		}
+	}
+	return true
+}
+
+// profileFor returns the first of the queue's profiles that can run a job
+// with the given agent query rules, or nil if the queue's own agents can run
+// it or no profile can.
+func (q *queue) profileFor(rules []string) *ProfileConfig {
+	if rulesMatch(agentTagMap(q.cfg, nil), rules) {
+		return nil
+	}
+
+	for _, p := range q.cfg.Profiles {
+		if p.matches(q.cfg, rules) {
+			return p
+		}
+	}
+	return nil
+}
+
+// profileLaunch is a number of instances to launch from a profile, or from
+// the queue's own template when Profile is nil.
+type profileLaunch struct {
+	Profile *ProfileConfig
+	Count   int64
+}
+
+// profileDeficits returns how many instances each of the queue's profiles
+// needs for the active jobs only it can run, beyond its live instances.
+func (s *scaler) profileDeficits(ctx context.Context, q *queue, instances []*gce.Instance, org string) ([]*profileLaunch, error) {
+	if len(q.cfg.Profiles) == 0 {
+		return nil, nil
+	}
+
+	jobs, err := s.buildkite.ListJobs(ctx, org, q.cfg.BuildkiteQueue, buildkite.ActiveJobStates)
+	if err != nil {
+		return nil, fmt.Errorf("Listing jobs failed: %v", err)
+	}
+
+	demand := make(map[*ProfileConfig]int64, len(q.cfg.Profiles))
+	for _, j := range jobs {
+		if p := q.profileFor(j.AgentQueryRules); p != nil {
+			demand[p]++
+		}
+	}
+
+	var deficits []*profileLaunch
+	for _, p := range q.cfg.Profiles {
+		live := int64(0)
+		for _, i := range instances {
+			if i.Live() && i.FromTemplate(p.InstanceTemplate) {
+				live++
+			}
+		}
+
+		n := instancesForJobs(demand[p], q.cfg.AgentsPerInstance, q.cfg.TargetUtilization) - live
+		if n > 0 {
+			q.logger.Debug("Profile is short of instances", "profile", p.Name, "jobs", demand[p], "live", live, "short", n)
+			deficits = append(deficits, &profileLaunch{Profile: p, Count: n})
+		}
+	}
+
+	return deficits, nil
+}
+
+// shortfall returns the total number of instances the deficits call for.
+func shortfall(deficits []*profileLaunch) int64 {
+	n := int64(0)
+	for _, d := range deficits {
+		n += d.Count
+	}
+	return n
+}
+
+// planLaunches splits a launch decision's count between the profiles that
+// are short of instances, in order, and the queue's own template, which gets
+// whatever remains, such as for other jobs, the minimum or forecast headroom.
+func planLaunches(d *Decision, deficits []*profileLaunch) []*profileLaunch {
+	if d.Action != DecisionLaunch {
+		return nil
+	}
+
+	var plan []*profileLaunch
+	count := d.Count
+	for _, def := range deficits {
+		n := def.Count
+		if n > count {
+			n = count
+		}
+		if n <= 0 {
+			break
+		}
+
+		plan = append(plan, &profileLaunch{Profile: def.Profile, Count: n})
+		count -= n
+	}
+	if count > 0 {
+		plan = append(plan, &profileLaunch{Count: count})
+	}
+
+	return plan
+}
@@ -0,0 +1,179 @@
+package scaler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/buildkite"
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func testProfileQueue() *queue {
+	qc := DefaultQueueConfig()
+	qc.BuildkiteQueue = "default"
+	qc.InstanceGroupTemplate = "agent"
+	qc.AgentTags = map[string]string{"size": "small"}
+	qc.Profiles = []*ProfileConfig{
+		{Name: "large", InstanceTemplate: "agent-large", AgentTags: map[string]string{"size": "large"}},
+		{Name: "arm64", InstanceTemplate: "agent-arm64", AgentTags: map[string]string{"arch": "arm64"}},
+	}
+	return &queue{cfg: qc, logger: hclog.NewNullLogger()}
+}
+
+func TestProfileMatches(t *testing.T) {
+	q := testProfileQueue()
+	large := q.cfg.Profiles[0]
+
+	cases := []struct {
+		rules    []string
+		expected bool
+	}{
+		{nil, true},
+		{[]string{"queue=default"}, true},
+		{[]string{"queue=other"}, false},
+		{[]string{"size=large"}, true},
+		{[]string{"size=small"}, false},
+		{[]string{"size=l*"}, true},
+		{[]string{"size!=small"}, true},
+		{[]string{"size!=large"}, false},
+		{[]string{"arch=arm64"}, false},
+		{[]string{"arch!=arm64"}, true},
+		{[]string{"queue=default", "size=large"}, true},
+		{[]string{"queue=default", "size=large", "arch=arm64"}, false},
+		{[]string{"invalid"}, false},
+	}
+
+	for _, tc := range cases {
+		if got := large.matches(q.cfg, tc.rules); got != tc.expected {
+			t.Errorf("matches(%q) = %v, expected %v", tc.rules, got, tc.expected)
+		}
+	}
+}
+
+func TestProfileFor(t *testing.T) {
+	q := testProfileQueue()
+
+	cases := []struct {
+		rules    []string
+		expected string
+	}{
+		// Jobs the queue's own agents can run never use a profile.
+		{nil, ""},
+		{[]string{"queue=default"}, ""},
+		{[]string{"queue=default", "size=small"}, ""},
+		{[]string{"size=s*"}, ""},
+		{[]string{"queue=default", "size=large"}, "large"},
+		{[]string{"size!=small"}, "large"},
+		{[]string{"arch=arm64"}, "arm64"},
+		{[]string{"size=large", "arch=arm64"}, ""},
+		{[]string{"queue=other"}, ""},
+	}
+
+	for _, tc := range cases {
+		got := ""
+		if p := q.profileFor(tc.rules); p != nil {
+			got = p.Name
+		}
+		if got != tc.expected {
+			t.Errorf("profileFor(%q) = %q, expected %q", tc.rules, got, tc.expected)
+		}
+	}
+}
+
+// fakeJobs is a Buildkite client that only lists jobs.
+type fakeJobs struct {
+	jobs []*buildkite.Job
+}
+
+func (f *fakeJobs) GetAgentMetricsByQueue(context.Context) (map[string]*buildkite.AgentMetrics, error) {
+	return nil, nil
+}
+
+func (f *fakeJobs) ListAgents(context.Context, string) ([]*buildkite.Agent, error) {
+	return nil, nil
+}
+
+func (f *fakeJobs) GetAgent(ctx context.Context, orgSlug, id string) (*buildkite.Agent, error) {
+	return nil, nil
+}
+
+func (f *fakeJobs) StopAgent(ctx context.Context, orgSlug, id string) error {
+	return nil
+}
+
+func (f *fakeJobs) CreateAgentToken(ctx context.Context, orgSlug, description string) (*buildkite.AgentToken, error) {
+	return nil, nil
+}
+
+func (f *fakeJobs) RevokeAgentToken(ctx context.Context, id, reason string) error {
+	return nil
+}
+
+func (f *fakeJobs) ListAgentTokens(ctx context.Context, orgSlug string) ([]*buildkite.AgentToken, error) {
+	return nil, nil
+}
+
+func (f *fakeJobs) ListJobs(ctx context.Context, orgSlug, queue string, states []string) ([]*buildkite.Job, error) {
+	return f.jobs, nil
+}
+
+func TestProfileDeficits(t *testing.T) {
+	job := func(rules ...string) *buildkite.Job {
+		return &buildkite.Job{AgentQueryRules: rules}
+	}
+
+	cases := []struct {
+		name      string
+		jobs      []*buildkite.Job
+		instances []*gce.Instance
+		expected  map[string]int64
+	}{
+		{
+			name:     "ignores jobs for the queue's own template",
+			jobs:     []*buildkite.Job{job(), job("queue=default"), job("queue=default", "size=small")},
+			expected: map[string]int64{},
+		},
+		{
+			name:     "counts jobs only a profile can run",
+			jobs:     []*buildkite.Job{job("queue=default"), job("size=large"), job("size=large"), job("arch=arm64")},
+			expected: map[string]int64{"large": 2, "arm64": 1},
+		},
+		{
+			name: "subtracts live instances from the profile's template",
+			jobs: []*buildkite.Job{job("size=large"), job("size=large"), job("arch=arm64")},
+			instances: []*gce.Instance{
+				{Name: "agent-large-0a0b0c", Status: "RUNNING"},
+				{Name: "agent-arm64-0a0b0c", Status: "PROVISIONING"},
+				{Name: "agent-0a0b0c", Status: "RUNNING"},
+				{Name: "agent-large-0d0e0f", Status: "TERMINATED"},
+			},
+			expected: map[string]int64{"large": 1},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := testProfileQueue()
+			s := &scaler{buildkite: &fakeJobs{jobs: tc.jobs}}
+
+			deficits, err := s.profileDeficits(context.Background(), q, tc.instances, "org")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]int64)
+			for _, d := range deficits {
+				got[d.Profile.Name] = d.Count
+			}
+			if len(got) != len(tc.expected) {
+				t.Fatalf("deficits %v, expected %v", got, tc.expected)
+			}
+			for name, n := range tc.expected {
+				if got[name] != n {
+					t.Errorf("deficits %v, expected %v", got, tc.expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package scaler
+
+import (
+	"context"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	reapReasonTerminated = "terminated"
+	reapReasonStuck      = "stuck"
+	reapReasonMissing    = "missing"
+)
+
+// Reap deletes members that have stopped, such as self-terminated agents and
+// preempted Spot VMs, and members that have been provisioning for longer than
+// the queue's ProvisioningTimeout. References to instances that no longer
+// exist are removed from the group.
+func (g *unmanagedGroup) Reap(ctx context.Context) (int64, error) {
+	members, err := g.Instances(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Instances that finish quickly may be reaped before they are counted,
+	// so they are seen here rather than left as in-flight.
+	g.q.sawInstances(members)
+
+	var (
+		reaped  int64
+		missing []*gce.Instance
+		result  error
+	)
+	for _, i := range members {
+		if i.Status == gce.StatusMissing {
+			missing = append(missing, i)
+			continue
+		}
+
+		reason := g.reapReason(i)
+		if reason == "" {
+			continue
+		}
+
+		g.q.logger.Info("Reaping instance", "name", i.Name, "zone", g.zone, "status", i.Status, "age", i.Age(), "reason", reason)
+		if err := g.s.gce.DeleteInstance(ctx, g.s.cfg.GCPProject, g.zone, i.Name); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		g.s.revokeAgentToken(ctx, i.Name, "instance deleted")
+		reapedCounter.WithLabelValues(g.q.cfg.BuildkiteQueue, reason).Inc()
+		reaped++
+	}
+
+	if len(missing) > 0 {
+		for _, m := range missing {
+			g.q.logger.Info("Reaping instance", "name", m.Name, "zone", g.zone, "reason", reapReasonMissing)
+		}
+
+		if err := g.s.gce.RemoveInstancesFromGroup(ctx, g.s.cfg.GCPProject, g.zone, g.name, missing); err != nil {
+			result = multierror.Append(result, err)
+		} else {
+			reapedCounter.WithLabelValues(g.q.cfg.BuildkiteQueue, reapReasonMissing).Add(float64(len(missing)))
+			reaped += int64(len(missing))
+		}
+	}
+
+	return reaped, result
+}
+
+// reapReason returns why the instance should be deleted, or an empty string
+// if it should be kept.
+func (g *unmanagedGroup) reapReason(i *gce.Instance) string {
+	switch i.Status {
+	case "TERMINATED", "STOPPED", "SUSPENDED":
+		return reapReasonTerminated
+	case "PROVISIONING", "STAGING":
+		timeout := g.q.cfg.ProvisioningTimeout
+		if timeout > 0 && i.Age() > timeout {
+			return reapReasonStuck
+		}
+	}
+
+	return ""
+}
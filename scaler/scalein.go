@@ -0,0 +1,180 @@
+package scaler
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/buildkite"
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// agentStopTimeout is how long scale-in waits for stopped agents to
+	// disconnect before leaving their instances for a later pass.
+	agentStopTimeout      = time.Minute
+	agentStopPollInterval = 2 * time.Second
+)
+
+// scaleIn deletes up to surplus instances whose agents have been idle for
+// longer than IdleTimeout, or that have lost their agents, returning the
+// number deleted. The agents are stopped first and instances are only
+// deleted once they have disconnected, so that a job picked up in the
+// meantime isn't killed. Instances that are still booting are never removed.
+func (s *scaler) scaleIn(ctx context.Context, q *queue, instances []*gce.Instance, orgSlug string, surplus int64) (int64, error) {
+	if s.cfg.BuildkiteAPIToken == "" {
+		q.logger.Debug("Skipping scale-in, no Buildkite API token configured", "surplus", surplus)
+		return 0, nil
+	}
+
+	statuses, err := s.instanceStatuses(ctx, q, instances, orgSlug)
+	if err != nil {
+		return 0, err
+	}
+
+	type candidate struct {
+		status    *InstanceStatus
+		idleSince time.Time
+	}
+
+	var candidates []candidate
+	for _, st := range statuses {
+		if st.State != InstanceIdle && st.State != InstanceLost {
+			continue
+		}
+
+		// Lost instances have no agents, so they sort first.
+		idleSince := st.IdleSince()
+		if time.Since(idleSince) < q.cfg.IdleTimeout {
+			continue
+		}
+
+		candidates = append(candidates, candidate{status: st, idleSince: idleSince})
+	}
+
+	// Remove the longest idle instances first.
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].idleSince.Before(candidates[j].idleSince)
+	})
+
+	if int64(len(candidates)) > surplus {
+		candidates = candidates[:surplus]
+	}
+
+	q.logger.Debug("Scaling in", "surplus", surplus, "idle", len(candidates))
+
+	toStop := make([]*InstanceStatus, 0, len(candidates))
+	for _, c := range candidates {
+		q.logger.Info("Removing instance", "name", c.status.Instance.Name, "state", c.status.State, "idle", time.Since(c.idleSince))
+		toStop = append(toStop, c.status)
+	}
+
+	toDelete, result := s.stopAgents(ctx, q, toStop, orgSlug)
+
+	deleted, err := q.group.Delete(ctx, toDelete)
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
+	if deleted > 0 && !s.cfg.DryRun {
+		q.lastScaleAction = time.Now()
+	}
+
+	return deleted, result
+}
+
+// stopAgents stops the agents of the given instances and waits up to
+// agentStopTimeout for them to disconnect, returning the instances whose
+// agents all did. Agents that picked up a job will stop once it finishes,
+// leaving their instance to be removed as lost by a later pass.
+func (s *scaler) stopAgents(ctx context.Context, q *queue, statuses []*InstanceStatus, orgSlug string) ([]*gce.Instance, error) {
+	if s.cfg.DryRun {
+		instances := make([]*gce.Instance, 0, len(statuses))
+		for _, st := range statuses {
+			instances = append(instances, st.Instance)
+		}
+		return instances, nil
+	}
+
+	var (
+		stopped []*gce.Instance
+		pending []*InstanceStatus
+		result  error
+	)
+	for _, st := range statuses {
+		if err := s.stopInstanceAgents(ctx, orgSlug, st); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		pending = append(pending, st)
+	}
+
+	deadline := time.Now().Add(agentStopTimeout)
+	for len(pending) > 0 {
+		var waiting []*InstanceStatus
+		for _, st := range pending {
+			done, busy, err := s.agentsStopped(ctx, orgSlug, st)
+			switch {
+			case err != nil:
+				result = multierror.Append(result, err)
+			case done:
+				stopped = append(stopped, st.Instance)
+			case busy:
+				q.logger.Info("Keeping instance, its agent picked up a job", "name", st.Instance.Name)
+			default:
+				waiting = append(waiting, st)
+			}
+		}
+
+		pending = waiting
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			for _, st := range pending {
+				q.logger.Warn("Keeping instance, its agent didn't stop in time", "name", st.Instance.Name, "timeout", agentStopTimeout)
+			}
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return stopped, multierror.Append(result, ctx.Err())
+		case <-time.After(agentStopPollInterval):
+		}
+	}
+
+	return stopped, result
+}
+
+func (s *scaler) stopInstanceAgents(ctx context.Context, orgSlug string, st *InstanceStatus) error {
+	for _, a := range st.Agents {
+		if err := s.buildkite.StopAgent(ctx, orgSlug, a.ID); err != nil && !buildkite.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// agentsStopped reports whether every agent of the instance has stopped, or
+// whether any of them is running a job.
+func (s *scaler) agentsStopped(ctx context.Context, orgSlug string, st *InstanceStatus) (bool, bool, error) {
+	done := true
+	for _, a := range st.Agents {
+		agent, err := s.buildkite.GetAgent(ctx, orgSlug, a.ID)
+		if buildkite.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, false, err
+		}
+
+		if agent.Busy() {
+			return false, true, nil
+		}
+		if !agent.Stopped() {
+			done = false
+		}
+	}
+	return done, false, nil
+}
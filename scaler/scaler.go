@@ -2,26 +2,149 @@ package scaler
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/endocrimes/buildkite-gcp-scaler/pkg/buildkite"
 	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+	"github.com/hashicorp/errwrap"
 	hclog "github.com/hashicorp/go-hclog"
+	multierror "github.com/hashicorp/go-multierror"
 )
 
 type Config struct {
-	GCPProject            string
-	GCPZone               string
-	InstanceGroupName     string
-	InstanceGroupTemplate string
-	BuildkiteQueue        string
-	BuildkiteToken        string
-
-	PollInterval *time.Duration
+	GCPProject        string `yaml:"gcp_project"`
+	BuildkiteToken    string `yaml:"buildkite_token"`
+	BuildkiteAPIToken string `yaml:"buildkite_api_token"`
+
+	// Queues binds each Buildkite queue to the instance group that runs its
+	// jobs.
+	Queues []*QueueConfig `yaml:"queues"`
+
+	// LaunchConcurrency is the number of instances of a queue that may be
+	// launched at the same time.
+	LaunchConcurrency int `yaml:"launch_concurrency"`
+
+	// DryRun logs the instances that would be launched or deleted instead of
+	// changing anything in GCE.
+	DryRun bool `yaml:"dry_run"`
+
+	// UnhealthyAfterFailures is the number of consecutive failed passes
+	// after which the scaler reports itself as not ready.
+	UnhealthyAfterFailures int `yaml:"unhealthy_after_failures"`
+	// StaleAfterIntervals is the number of poll intervals without a
+	// completed pass after which the scaler reports itself as not ready.
+	StaleAfterIntervals int `yaml:"stale_after_intervals"`
+
+	PollInterval *time.Duration `yaml:"interval"`
+
+	// ScalerID identifies this scaler in the labels and metadata of the
+	// instances it launches. It defaults to the hostname.
+	ScalerID string `yaml:"scaler_id"`
+
+	// DynamicAgentTokens creates a registration token for every instance
+	// through the GraphQL API and passes it to the instance as the
+	// AgentTokenMetadataKey metadata item. Tokens are revoked when their
+	// instance is deleted, or after AgentTokenTTL. This requires a
+	// BuildkiteAPIToken with GraphQL access.
+	DynamicAgentTokens    bool          `yaml:"dynamic_agent_tokens"`
+	AgentTokenTTL         time.Duration `yaml:"agent_token_ttl"`
+	AgentTokenMetadataKey string        `yaml:"agent_token_metadata_key"`
+
+	// HistoryFile persists the demand history used by queue forecasts
+	// across restarts. History is only kept in memory when it is unset.
+	HistoryFile string `yaml:"history_file"`
+}
+
+// QueueConfig describes how a single Buildkite queue is scaled.
+type QueueConfig struct {
+	BuildkiteQueue        string `yaml:"name"`
+	GCPZone               string `yaml:"gcp_zone"`
+	InstanceGroupName     string `yaml:"instance_group"`
+	InstanceGroupTemplate string `yaml:"instance_template"`
+
+	// InstanceGroupType is either GroupTypeUnmanaged (the default) or
+	// GroupTypeManaged. Managed groups use their own instance template.
+	InstanceGroupType string `yaml:"instance_group_type"`
+	// GCPRegion is set instead of GCPZone for regional managed instance
+	// groups.
+	GCPRegion string `yaml:"gcp_region"`
+
+	// Zones spreads an unmanaged queue across several zones, each with its
+	// own instance group, instead of using GCPZone. Placement selects how
+	// launches are distributed between them, and zones that run out of
+	// capacity are skipped for ZoneFailureCooldown.
+	Zones               []*ZoneConfig `yaml:"zones"`
+	Placement           string        `yaml:"placement"`
+	ZoneFailureCooldown time.Duration `yaml:"zone_failure_cooldown"`
+
+	// SpotInstanceTemplate is an instance template for Spot VMs. When set,
+	// SpotRatio of the group's live instances are launched from it, and
+	// spot launches that fail for lack of capacity are retried with
+	// InstanceGroupTemplate.
+	SpotInstanceTemplate string  `yaml:"spot_template"`
+	SpotRatio            float64 `yaml:"spot_ratio"`
+
+	// AgentsPerInstance is the number of agents each instance runs, and so
+	// the number of jobs it can run at once.
+	AgentsPerInstance int64 `yaml:"agents_per_instance"`
+	// TargetUtilization is the percentage of agents that should be busy
+	// when the queue is scaled to demand. Lower values keep spare agents.
+	TargetUtilization int64 `yaml:"target_utilization"`
+
+	// MinInstances is the number of instances kept running even when there
+	// are no jobs.
+	MinInstances int64 `yaml:"min_instances"`
+	// Schedules raise MinInstances during given time windows.
+	Schedules []*ScheduleConfig `yaml:"schedules"`
+	// Forecast adds headroom based on the queue's demand history.
+	Forecast *ForecastConfig `yaml:"forecast"`
+
+	// Profiles route jobs to other instance templates based on their agent
+	// query rules. Jobs that match no profile use InstanceGroupTemplate.
+	Profiles []*ProfileConfig `yaml:"profiles"`
+
+	// Labels and Metadata are added to every instance launched into an
+	// unmanaged group, along with the scaler's own. AgentTags are passed in
+	// the MetadataAgentTags metadata item.
+	Labels    map[string]string `yaml:"labels"`
+	Metadata  map[string]string `yaml:"metadata"`
+	AgentTags map[string]string `yaml:"agent_tags"`
+	// MaxInstances caps the size of the group. Zero means unlimited.
+	MaxInstances int64 `yaml:"max_instances"`
+	// MaxLaunchPerPass caps the number of instances launched by a single
+	// pass. Zero means unlimited.
+	MaxLaunchPerPass int64 `yaml:"max_launch_per_pass"`
+
+	// IdleTimeout is how long an agent must have been idle before its
+	// instance is eligible for removal. Scale-in is disabled when no
+	// BuildkiteAPIToken is configured.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// ScaleInCooldown is the minimum time between a scaling action and the
+	// next scale-in, and ScaleOutCooldown the minimum time between launches.
+	ScaleInCooldown  time.Duration `yaml:"scale_in_cooldown"`
+	ScaleOutCooldown time.Duration `yaml:"scale_out_cooldown"`
+	// ScaleInHysteresis is the number of surplus instances tolerated before
+	// scaling in, so that small fluctuations in demand don't cause instances
+	// to be deleted and relaunched.
+	ScaleInHysteresis int64 `yaml:"scale_in_hysteresis"`
+
+	// ProvisioningTimeout is how long an instance may stay PROVISIONING or
+	// STAGING before it is deleted as stuck. Zero disables the check.
+	ProvisioningTimeout time.Duration `yaml:"provisioning_timeout"`
+	// BootTimeout is how long a running instance may go without a connected
+	// agent before it is considered lost.
+	BootTimeout time.Duration `yaml:"boot_timeout"`
 }
 
 type Scaler interface {
 	Run(context.Context) error
+
+	// Health reports the outcome of recent passes.
+	Health() *Health
+
+	// Status reports the instances of every queue and their agents.
+	Status(context.Context) ([]*QueueStatus, error)
 }
 
 func NewAutoscaler(cfg *Config, logger hclog.Logger) Scaler {
@@ -31,26 +154,129 @@ func NewAutoscaler(cfg *Config, logger hclog.Logger) Scaler {
 		panic(err)
 	}
 
-	return &scaler{
+	if cfg.ScalerID == "" {
+		cfg.ScalerID = defaultScalerID()
+	}
+
+	s := &scaler{
 		cfg:       cfg,
-		logger:    logger.Named("scaler").With("queue", cfg.BuildkiteQueue),
-		buildkite: buildkite.NewClient(cfg.BuildkiteToken, logger),
+		logger:    logger.Named("scaler"),
+		buildkite: buildkite.NewClient(cfg.BuildkiteToken, cfg.BuildkiteAPIToken, logger),
 		gce:       client,
+		health:    newHealthTracker(),
+
+		agentTokens: make(map[string]string),
+	}
+
+	if cfg.DryRun {
+		s.logger = s.logger.With("dry_run", true)
+		s.gce = &dryRunGCE{Client: client, logger: s.logger}
+	}
+
+	var histories map[string]*history
+	if cfg.HistoryFile != "" {
+		histories, err = loadHistory(cfg.HistoryFile)
+		if err != nil {
+			s.logger.Warn("Failed to load history, starting afresh", "path", cfg.HistoryFile, "error", err)
+		}
+	}
+
+	for _, qc := range cfg.Queues {
+		q := &queue{
+			cfg:    qc,
+			logger: s.logger.With("queue", qc.BuildkiteQueue),
+		}
+		q.group = newGroup(s, q)
+
+		for _, sc := range qc.Schedules {
+			sched, err := sc.parse()
+			if err != nil {
+				// Validate rejects invalid schedules, so this can only
+				// happen if it wasn't called.
+				panic(err)
+			}
+			q.schedules = append(q.schedules, sched)
+		}
+
+		if qc.Forecast != nil {
+			q.history = histories[qc.BuildkiteQueue]
+			if q.history == nil {
+				q.history = &history{}
+			}
+		}
+		s.queues = append(s.queues, q)
 	}
+
+	return s
 }
 
 type scaler struct {
 	cfg *Config
 
 	gce interface {
-		LiveInstanceCount(ctx context.Context, projectID, zone, instanceGroupName string) (int64, error)
-		LaunchInstanceForGroup(ctx context.Context, projectID, zone, groupName, templateName string) error
+		LaunchInstanceForGroup(ctx context.Context, projectID, zone, groupName, templateName string, opts *gce.LaunchOptions) error
+		ListGroupInstances(ctx context.Context, projectID, zone, instanceGroupName string) ([]*gce.Instance, error)
+		DeleteInstance(ctx context.Context, projectID, zone, name string) error
+		RemoveInstancesFromGroup(ctx context.Context, projectID, zone, groupName string, instances []*gce.Instance) error
+
+		ListManagedInstances(ctx context.Context, g *gce.ManagedGroup) ([]*gce.Instance, error)
+		ResizeManagedGroup(ctx context.Context, g *gce.ManagedGroup, size int64) error
+		DeleteManagedInstances(ctx context.Context, g *gce.ManagedGroup, instances []*gce.Instance) error
 	}
 
 	buildkite interface {
-		GetAgentMetrics(context.Context, string) (*buildkite.AgentMetrics, error)
+		GetAgentMetricsByQueue(context.Context) (map[string]*buildkite.AgentMetrics, error)
+		ListAgents(context.Context, string) ([]*buildkite.Agent, error)
+		GetAgent(ctx context.Context, orgSlug, id string) (*buildkite.Agent, error)
+		StopAgent(ctx context.Context, orgSlug, id string) error
+
+		CreateAgentToken(ctx context.Context, orgSlug, description string) (*buildkite.AgentToken, error)
+		RevokeAgentToken(ctx context.Context, id, reason string) error
+		ListAgentTokens(ctx context.Context, orgSlug string) ([]*buildkite.AgentToken, error)
+
+		ListJobs(ctx context.Context, orgSlug, queue string, states []string) ([]*buildkite.Job, error)
 	}
 
+	// org is the slug of the Buildkite organization, learnt from the agent
+	// metrics.
+	org string
+
+	// agentTokens maps instance names to the IDs of the agent tokens created
+	// for them.
+	agentTokens   map[string]string
+	agentTokensMu sync.Mutex
+
+	queues []*queue
+
+	// historySaved is when Config.HistoryFile was last written.
+	historySaved time.Time
+
+	health *healthTracker
+
+	logger hclog.Logger
+}
+
+// queue holds the state kept between passes for a single QueueConfig.
+type queue struct {
+	cfg       *QueueConfig
+	group     group
+	schedules []*schedule
+
+	// history is only kept for queues with a forecast.
+	history *history
+
+	// lastScaleAction is the time of the most recent launch or deletion, used
+	// to enforce ScaleInCooldown between passes. lastScaleOut is the time of
+	// the most recent launch, used to enforce ScaleOutCooldown.
+	lastScaleAction time.Time
+	lastScaleOut    time.Time
+
+	// launches maps the names of instances launched into unmanaged groups
+	// to their launch time until they are seen in the group. Managed groups
+	// list the instances they are creating, so don't need it.
+	launches   map[string]time.Time
+	launchesMu sync.Mutex
+
 	logger hclog.Logger
 }
 
@@ -59,45 +285,205 @@ func (s *scaler) Run(ctx context.Context) error {
 	for {
 		select {
 		case <-ctx.Done():
+			s.maybeSaveHistory(true)
 			return ctx.Err()
 		case <-ticker.C:
 
-			if err := s.run(ctx); err != nil {
+			summary, err := s.run(ctx)
+			if err != nil {
 				s.logger.Error("Autoscaling failed", "error", err)
 			}
+			summary.log(s.logger)
+			s.health.record(err)
 
 			if s.cfg.PollInterval != nil {
 				ticker.Reset(*s.cfg.PollInterval)
 			} else {
+				s.maybeSaveHistory(true)
 				return nil
 			}
 		}
 	}
 }
 
-func (s *scaler) run(ctx context.Context) error {
-	metrics, err := s.buildkite.GetAgentMetrics(ctx, s.cfg.BuildkiteQueue)
+func (s *scaler) Health() *Health {
+	return s.health.health(s.cfg)
+}
+
+func (s *scaler) run(ctx context.Context) (*passSummary, error) {
+	summary := &passSummary{}
+
+	metrics, err := s.buildkite.GetAgentMetricsByQueue(ctx)
 	if err != nil {
-		return err
+		// An unreadable response must not be mistaken for empty queues, so
+		// leave every queue as it is until the metrics can be read.
+		if buildkite.IsUnauthorized(err) {
+			s.logger.Error("Buildkite rejected the agent token, check buildkite_token")
+		}
+		return summary, errwrap.Wrapf("Reading Buildkite metrics failed, not scaling: {{err}}", err)
+	}
+
+	if slug := orgSlug(metrics); slug != "" {
+		s.org = slug
+	}
+
+	var result error
+	for _, q := range s.queues {
+		m, ok := metrics[q.cfg.BuildkiteQueue]
+		if !ok {
+			// Queues without jobs aren't reported, but still need the
+			// organization to scale in.
+			q.logger.Debug("Queue has no jobs")
+			m = &buildkite.AgentMetrics{OrgSlug: s.org, Queue: q.cfg.BuildkiteQueue}
+		}
+
+		qs := &queueSummary{Queue: q.cfg.BuildkiteQueue}
+		summary.Queues = append(summary.Queues, qs)
+
+		if err := s.reconcile(ctx, q, m, qs); err != nil {
+			q.logger.Error("Scaling queue failed", "error", err)
+			result = multierror.Append(result, err)
+		}
+	}
+
+	if s.cfg.DynamicAgentTokens {
+		if err := s.sweepAgentTokens(ctx); err != nil {
+			s.logger.Warn("Sweeping agent tokens failed", "error", err)
+		}
+	}
+
+	s.maybeSaveHistory(false)
+
+	return summary, result
+}
+
+func (s *scaler) reconcile(ctx context.Context, q *queue, metrics *buildkite.AgentMetrics, summary *queueSummary) error {
+	var err error
+
+	scheduledJobsGauge.WithLabelValues(q.cfg.BuildkiteQueue).Set(float64(metrics.ScheduledJobs))
+	runningJobsGauge.WithLabelValues(q.cfg.BuildkiteQueue).Set(float64(metrics.RunningJobs))
+	waitingJobsGauge.WithLabelValues(q.cfg.BuildkiteQueue).Set(float64(metrics.WaitingJobs))
+	agentsGauge.WithLabelValues(q.cfg.BuildkiteQueue, "idle").Set(float64(metrics.IdleAgents))
+	agentsGauge.WithLabelValues(q.cfg.BuildkiteQueue, "busy").Set(float64(metrics.BusyAgents))
+
+	if q.history != nil {
+		q.history.add(q.cfg.Forecast, &sample{Time: time.Now(), Scheduled: metrics.ScheduledJobs, Running: metrics.RunningJobs})
+	}
+
+	// Reap before counting, so that stuck instances aren't mistaken for
+	// capacity. A failure here shouldn't stop the queue from scaling.
+	summary.Reaped, err = q.group.Reap(ctx)
+	if err != nil {
+		q.logger.Warn("Reaping instances failed", "error", err)
 	}
-	totalInstanceRequirement := metrics.ScheduledJobs + metrics.RunningJobs
 
-	liveInstanceCount, err := s.gce.LiveInstanceCount(ctx, s.cfg.GCPProject, s.cfg.GCPZone, s.cfg.InstanceGroupName)
+	instances, err := q.group.Instances(ctx)
 	if err != nil {
 		return err
 	}
+	c := newCapacity(instances)
+	c.InFlight = q.inFlight(instances, time.Now())
+	liveInstancesGauge.WithLabelValues(q.cfg.BuildkiteQueue).Set(float64(c.Live()))
+	instancesGauge.WithLabelValues(q.cfg.BuildkiteQueue, "pending").Set(float64(c.Pending))
+	instancesGauge.WithLabelValues(q.cfg.BuildkiteQueue, "available").Set(float64(c.Available))
+	instancesGauge.WithLabelValues(q.cfg.BuildkiteQueue, "draining").Set(float64(c.Draining))
+	instancesGauge.WithLabelValues(q.cfg.BuildkiteQueue, "in_flight").Set(float64(c.InFlight))
+	q.logger.Debug("Capacity", "pending", c.Pending, "available", c.Available, "draining", c.Draining, "in_flight", c.InFlight)
 
-	if liveInstanceCount >= totalInstanceRequirement {
-		return nil
+	deficits, err := s.profileDeficits(ctx, q, instances, metrics.OrgSlug)
+	if err != nil {
+		// Fall back to the queue's own template rather than not scaling.
+		q.logger.Warn("Finding profile demand failed", "error", err)
 	}
+	c.ProfileShortfall = shortfall(deficits)
 
-	required := totalInstanceRequirement - liveInstanceCount
+	d := q.decide(metrics, c)
+	desiredInstancesGauge.WithLabelValues(q.cfg.BuildkiteQueue).Set(float64(d.Desired))
+	externalAgentsGauge.WithLabelValues(q.cfg.BuildkiteQueue).Set(float64(d.ExternalAgents))
 
-	for i := int64(0); i < required; i++ {
-		err := s.gce.LaunchInstanceForGroup(ctx, s.cfg.GCPProject, s.cfg.GCPZone, s.cfg.InstanceGroupName, s.cfg.InstanceGroupTemplate)
+	if s.cfg.DryRun {
+		q.logger.Info("Scaling decision", "scheduled", metrics.ScheduledJobs, "running", metrics.RunningJobs, "external_agents", d.ExternalAgents, "desired", d.Desired, "live", d.Live, "in_flight", d.InFlight, "action", d.Action, "count", d.Count, "reason", d.Reason)
+	}
+
+	switch d.Action {
+	case DecisionScaleIn:
+		summary.Deleted, err = s.scaleIn(ctx, q, instances, metrics.OrgSlug, d.Count)
+		deletionsCounter.WithLabelValues(q.cfg.BuildkiteQueue).Add(float64(summary.Deleted))
+		return err
+	case DecisionLaunch:
+		return s.launch(ctx, q, d, planLaunches(d, deficits), summary)
+	}
+
+	return nil
+}
+
+// launch carries out a launch decision's planned launches. Launches for a
+// profile are always for demand; the rest are for the decision's reason.
+func (s *scaler) launch(ctx context.Context, q *queue, d *Decision, plan []*profileLaunch, summary *queueSummary) error {
+	var (
+		requested int64
+		result    error
+	)
+	for _, l := range plan {
+		reason := d.LaunchReason
+		if l.Profile != nil {
+			reason = LaunchReasonDemand
+		}
+
+		launched, err := q.group.Launch(ctx, l.Count, reason, l.Profile)
 		if err != nil {
-			return err
+			result = multierror.Append(result, err)
 		}
+		requested += l.Count
+		summary.Launched += launched
 	}
-	return nil
+	if requested == 0 {
+		return nil
+	}
+
+	summary.LaunchFailed = requested - summary.Launched
+
+	// Pretend launches mustn't start cooldowns, or every later decision in
+	// a dry run would differ from the one a real run makes.
+	if summary.Launched > 0 && !s.cfg.DryRun {
+		q.lastScaleAction = time.Now()
+		q.lastScaleOut = q.lastScaleAction
+	}
+	launchesCounter.WithLabelValues(q.cfg.BuildkiteQueue).Add(float64(requested))
+	launchFailuresCounter.WithLabelValues(q.cfg.BuildkiteQueue).Add(float64(summary.LaunchFailed))
+	return result
+}
+
+// desiredInstanceCount returns the number of instances needed to run jobs
+// with the configured agents per instance and utilization, plus headroom,
+// clamped to minInstances and MaxInstances.
+func (q *queue) desiredInstanceCount(jobs, headroom, minInstances int64) int64 {
+	needed := instancesForJobs(jobs, q.cfg.AgentsPerInstance, q.cfg.TargetUtilization) + headroom
+
+	desired := needed
+	if desired < minInstances {
+		desired = minInstances
+	}
+	if q.cfg.MaxInstances > 0 && desired > q.cfg.MaxInstances {
+		desired = q.cfg.MaxInstances
+	}
+
+	if desired != needed {
+		q.logger.Debug("Clamped desired instance count", "jobs", jobs, "needed", needed, "desired", desired)
+	}
+	return desired
+}
+
+// instancesForJobs returns ceil(jobs / agentsPerInstance / utilization%),
+// treating unset values as one agent per instance at full utilization.
+func instancesForJobs(jobs, agentsPerInstance, utilization int64) int64 {
+	if agentsPerInstance < 1 {
+		agentsPerInstance = 1
+	}
+	if utilization < 1 || utilization > 100 {
+		utilization = 100
+	}
+
+	capacity := agentsPerInstance * utilization
+	return (jobs*100 + capacity - 1) / capacity
 }
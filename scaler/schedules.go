@@ -0,0 +1,63 @@
+package scaler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/cron"
+)
+
+// ScheduleConfig raises a queue's minimum instance count while the current
+// time matches a cron expression, e.g. "* 9-17 * * 1-5" for weekday business
+// hours.
+type ScheduleConfig struct {
+	Name string `yaml:"name"`
+	Cron string `yaml:"cron"`
+	// Timezone is an IANA time zone name such as Europe/London. It defaults
+	// to UTC.
+	Timezone     string `yaml:"timezone"`
+	MinInstances int64  `yaml:"min_instances"`
+}
+
+// schedule is a parsed ScheduleConfig.
+type schedule struct {
+	cfg      *ScheduleConfig
+	cron     *cron.Schedule
+	location *time.Location
+}
+
+func (sc *ScheduleConfig) parse() (*schedule, error) {
+	c, err := cron.Parse(sc.Cron)
+	if err != nil {
+		return nil, fmt.Errorf("cron: %v", err)
+	}
+
+	loc := time.UTC
+	if sc.Timezone != "" {
+		loc, err = time.LoadLocation(sc.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("timezone: %v", err)
+		}
+	}
+
+	return &schedule{cfg: sc, cron: c, location: loc}, nil
+}
+
+func (s *schedule) active(now time.Time) bool {
+	return s.cron.Matches(now.In(s.location))
+}
+
+// minInstances returns the queue's minimum instance count at the given time,
+// raised by any schedules that are active.
+func (q *queue) minInstances(now time.Time) int64 {
+	min := q.cfg.MinInstances
+	for _, s := range q.schedules {
+		if !s.active(now) || s.cfg.MinInstances <= min {
+			continue
+		}
+
+		q.logger.Debug("Schedule raised minimum instances", "schedule", s.cfg.Name, "min", s.cfg.MinInstances)
+		min = s.cfg.MinInstances
+	}
+	return min
+}
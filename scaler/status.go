@@ -0,0 +1,89 @@
+package scaler
+
+import (
+	"context"
+	"time"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/buildkite"
+)
+
+// QueueStatus describes the jobs and instances of a single queue and what
+// the scaler would do about them.
+type QueueStatus struct {
+	Queue         string `json:"queue"`
+	ScheduledJobs int64  `json:"scheduled_jobs"`
+	RunningJobs   int64  `json:"running_jobs"`
+	WaitingJobs   int64  `json:"waiting_jobs"`
+	IdleAgents    int64  `json:"idle_agents"`
+	BusyAgents    int64  `json:"busy_agents"`
+
+	Pending   int64 `json:"pending"`
+	Available int64 `json:"available"`
+	Draining  int64 `json:"draining"`
+
+	Decision  *Decision         `json:"decision"`
+	Instances []*InstanceStatus `json:"instances"`
+}
+
+// Status reports the state of every queue and the decision a pass would make
+// right now, without changing anything.
+func (s *scaler) Status(ctx context.Context) ([]*QueueStatus, error) {
+	metrics, err := s.buildkite.GetAgentMetricsByQueue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	slug := orgSlug(metrics)
+
+	var statuses []*QueueStatus
+	for _, q := range s.queues {
+		m, ok := metrics[q.cfg.BuildkiteQueue]
+		if !ok {
+			m = &buildkite.AgentMetrics{OrgSlug: slug, Queue: q.cfg.BuildkiteQueue}
+		}
+
+		instances, err := q.group.Instances(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c := newCapacity(instances)
+		c.InFlight = q.inFlight(instances, time.Now())
+
+		deficits, err := s.profileDeficits(ctx, q, instances, slug)
+		if err != nil {
+			return nil, err
+		}
+		c.ProfileShortfall = shortfall(deficits)
+
+		is, err := s.instanceStatuses(ctx, q, instances, slug)
+		if err != nil {
+			return nil, err
+		}
+
+		statuses = append(statuses, &QueueStatus{
+			Queue:         q.cfg.BuildkiteQueue,
+			ScheduledJobs: m.ScheduledJobs,
+			RunningJobs:   m.RunningJobs,
+			WaitingJobs:   m.WaitingJobs,
+			IdleAgents:    m.IdleAgents,
+			BusyAgents:    m.BusyAgents,
+			Pending:       c.Pending,
+			Available:     c.Available,
+			Draining:      c.Draining,
+			Decision:      q.decide(m, c),
+			Instances:     is,
+		})
+	}
+
+	return statuses, nil
+}
+
+// orgSlug returns the organization the agent token belongs to, which is the
+// same for every queue. It is empty if the organization has no queues.
+func orgSlug(metrics map[string]*buildkite.AgentMetrics) string {
+	for _, m := range metrics {
+		if m.OrgSlug != "" {
+			return m.OrgSlug
+		}
+	}
+	return ""
+}
@@ -0,0 +1,28 @@
+package scaler
+
+import (
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// passSummary reports the actions taken during a single pass.
+type passSummary struct {
+	Queues []*queueSummary
+}
+
+type queueSummary struct {
+	Queue        string
+	Launched     int64
+	LaunchFailed int64
+	Deleted      int64
+	Reaped       int64
+}
+
+func (p *passSummary) log(logger hclog.Logger) {
+	for _, q := range p.Queues {
+		if q.Launched == 0 && q.LaunchFailed == 0 && q.Deleted == 0 && q.Reaped == 0 {
+			continue
+		}
+
+		logger.Info("Pass complete", "queue", q.Queue, "launched", q.Launched, "launch_failed", q.LaunchFailed, "deleted", q.Deleted, "reaped", q.Reaped)
+	}
+}
@@ -0,0 +1,141 @@
+package scaler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAgentTokenTTL         = time.Hour
+	DefaultAgentTokenMetadataKey = "buildkite-agent-token"
+)
+
+// agentTokenDescription identifies the tokens this scaler created, and the
+// instance each one is for, by their description.
+func (s *scaler) agentTokenDescription(instanceName string) string {
+	return s.agentTokenDescriptionPrefix() + instanceName
+}
+
+// agentTokenDescriptionPrefix includes the ScalerID, so that scalers sharing
+// an organization only sweep their own tokens.
+func (s *scaler) agentTokenDescriptionPrefix() string {
+	return fmt.Sprintf("buildkite-gcp-scaler/%s: ", s.cfg.ScalerID)
+}
+
+// createAgentToken creates a registration token for a single instance.
+func (s *scaler) createAgentToken(ctx context.Context, instanceName string) (string, error) {
+	if s.org == "" {
+		return "", fmt.Errorf("Creating an agent token requires the organization, which is not known yet")
+	}
+
+	if s.cfg.DryRun {
+		s.logger.Info("Would create agent token", "instance", instanceName)
+		return "dry-run", nil
+	}
+
+	token, err := s.buildkite.CreateAgentToken(ctx, s.org, s.agentTokenDescription(instanceName))
+	if err != nil {
+		return "", fmt.Errorf("Failed to create agent token for %s: %v", instanceName, err)
+	}
+	agentTokensCreatedCounter.Inc()
+
+	s.agentTokensMu.Lock()
+	s.agentTokens[instanceName] = token.ID
+	s.agentTokensMu.Unlock()
+
+	return token.Token, nil
+}
+
+// revokeAgentToken revokes the token created for an instance, if this
+// process created one. Failures are only logged, since the sweep will retry.
+func (s *scaler) revokeAgentToken(ctx context.Context, instanceName, reason string) {
+	if !s.cfg.DynamicAgentTokens {
+		return
+	}
+
+	s.agentTokensMu.Lock()
+	id, ok := s.agentTokens[instanceName]
+	delete(s.agentTokens, instanceName)
+	s.agentTokensMu.Unlock()
+	if !ok {
+		return
+	}
+
+	s.revokeAgentTokenByID(ctx, id, instanceName, reason)
+}
+
+func (s *scaler) revokeAgentTokenByID(ctx context.Context, id, instanceName, reason string) {
+	if s.cfg.DryRun {
+		s.logger.Info("Would revoke agent token", "instance", instanceName, "reason", reason)
+		return
+	}
+
+	s.logger.Info("Revoking agent token", "instance", instanceName, "reason", reason)
+	if err := s.buildkite.RevokeAgentToken(ctx, id, reason); err != nil {
+		s.logger.Warn("Failed to revoke agent token", "instance", instanceName, "error", err)
+		return
+	}
+	agentTokensRevokedCounter.WithLabelValues(reason).Inc()
+}
+
+// sweepAgentTokens revokes the tokens this scaler created whose instances no
+// longer exist, and those older than AgentTokenTTL. Agents only need their
+// token to register, so revoking it doesn't affect running agents.
+func (s *scaler) sweepAgentTokens(ctx context.Context) error {
+	if s.org == "" {
+		return nil
+	}
+
+	live := make(map[string]bool)
+	for _, q := range s.queues {
+		instances, err := q.group.Instances(ctx)
+		if err != nil {
+			// Without the full inventory we can't tell which tokens are
+			// still needed.
+			return err
+		}
+		for _, i := range instances {
+			if i.Live() {
+				live[i.Name] = true
+			}
+		}
+	}
+
+	tokens, err := s.buildkite.ListAgentTokens(ctx, s.org)
+	if err != nil {
+		return err
+	}
+
+	ttl := s.cfg.AgentTokenTTL
+	if ttl <= 0 {
+		ttl = DefaultAgentTokenTTL
+	}
+
+	prefix := s.agentTokenDescriptionPrefix()
+	for _, t := range tokens {
+		if !strings.HasPrefix(t.Description, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(t.Description, prefix)
+
+		var reason string
+		switch {
+		case !live[name]:
+			reason = "instance gone"
+		case time.Since(t.CreatedAt) > ttl:
+			reason = "expired"
+		default:
+			continue
+		}
+
+		s.agentTokensMu.Lock()
+		delete(s.agentTokens, name)
+		s.agentTokensMu.Unlock()
+
+		s.revokeAgentTokenByID(ctx, t.ID, name, reason)
+	}
+
+	return nil
+}
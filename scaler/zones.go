@@ -0,0 +1,254 @@
+package scaler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/pkg/gce"
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+const (
+	// PlacementRoundRobin launches into each healthy zone in turn.
+	PlacementRoundRobin = "round-robin"
+	// PlacementLeastLoaded launches into the healthy zone with the fewest
+	// live instances.
+	PlacementLeastLoaded = "least-loaded"
+	// PlacementWeighted keeps the number of live instances in each healthy
+	// zone proportional to its weight.
+	PlacementWeighted = "weighted"
+
+	DefaultZoneFailureCooldown = 10 * time.Minute
+)
+
+// ZoneConfig is one of the zones a queue's instances are spread across.
+type ZoneConfig struct {
+	Zone string `yaml:"zone"`
+	// InstanceGroupName defaults to the queue's InstanceGroupName.
+	InstanceGroupName string `yaml:"instance_group"`
+	// Weight is only used by PlacementWeighted. It defaults to 1.
+	Weight int64 `yaml:"weight"`
+}
+
+// zone is the per-zone state of a multiZoneGroup.
+type zone struct {
+	*unmanagedGroup
+
+	weight         int64
+	unhealthyUntil time.Time
+}
+
+func (z *zone) healthy(now time.Time) bool {
+	return !now.Before(z.unhealthyUntil)
+}
+
+// multiZoneGroup spreads a queue's instances across unmanaged groups in
+// several zones, failing over to other zones when one runs out of capacity.
+type multiZoneGroup struct {
+	q     *queue
+	zones []*zone
+
+	// next is the index of the zone that round-robin placement will use
+	// for its next launch.
+	next int
+}
+
+func newMultiZoneGroup(s *scaler, q *queue) *multiZoneGroup {
+	g := &multiZoneGroup{q: q}
+	for _, zc := range q.cfg.Zones {
+		name := zc.InstanceGroupName
+		if name == "" {
+			name = q.cfg.InstanceGroupName
+		}
+
+		weight := zc.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		g.zones = append(g.zones, &zone{
+			unmanagedGroup: &unmanagedGroup{s: s, q: q, zone: zc.Zone, name: name},
+			weight:         weight,
+		})
+	}
+
+	return g
+}
+
+func (g *multiZoneGroup) Instances(ctx context.Context) ([]*gce.Instance, error) {
+	var instances []*gce.Instance
+	for _, z := range g.zones {
+		zoneInstances, err := z.Instances(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", z.zone, err)
+		}
+		instances = append(instances, zoneInstances...)
+	}
+
+	return instances, nil
+}
+
+func (g *multiZoneGroup) Delete(ctx context.Context, instances []*gce.Instance) (int64, error) {
+	byZone := make(map[string][]*gce.Instance)
+	for _, i := range instances {
+		byZone[i.Zone] = append(byZone[i.Zone], i)
+	}
+
+	var (
+		deleted int64
+		result  error
+	)
+	for _, z := range g.zones {
+		n, err := z.Delete(ctx, byZone[z.zone])
+		deleted += n
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("%s: %v", z.zone, err))
+		}
+	}
+
+	return deleted, result
+}
+
+func (g *multiZoneGroup) Reap(ctx context.Context) (int64, error) {
+	var (
+		reaped int64
+		result error
+	)
+	for _, z := range g.zones {
+		n, err := z.Reap(ctx)
+		reaped += n
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("%s: %v", z.zone, err))
+		}
+	}
+
+	return reaped, result
+}
+
+// Launch distributes count launches across the healthy zones. Zones whose
+// launches fail because of stockouts or quotas are marked unhealthy and the
+// failed launches are retried in the remaining zones.
+func (g *multiZoneGroup) Launch(ctx context.Context, count int64, reason string, profile *ProfileConfig) (int64, error) {
+	var (
+		launched int64
+		result   error
+	)
+
+	for remaining := count; remaining > 0; {
+		healthy := g.healthyZones()
+		if len(healthy) == 0 {
+			result = multierror.Append(result, fmt.Errorf("no healthy zones available for %d instances", remaining))
+			break
+		}
+
+		plan, err := g.plan(ctx, healthy, remaining)
+		if err != nil {
+			return launched, multierror.Append(result, err)
+		}
+
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			failover bool
+		)
+		for z, n := range plan {
+			wg.Add(1)
+			go func(z *zone, n int64) {
+				defer wg.Done()
+				got, err := z.Launch(ctx, n, reason, profile)
+
+				mu.Lock()
+				defer mu.Unlock()
+				launched += got
+				remaining -= got
+				if err == nil {
+					return
+				}
+
+				result = multierror.Append(result, fmt.Errorf("%s: %v", z.zone, err))
+				if gce.IsCapacityError(err) {
+					g.markUnhealthy(z)
+					failover = true
+				}
+			}(z, n)
+		}
+		wg.Wait()
+
+		// Only launches that failed for lack of capacity are worth retrying
+		// elsewhere.
+		if !failover {
+			break
+		}
+	}
+
+	return launched, result
+}
+
+func (g *multiZoneGroup) healthyZones() []*zone {
+	now := time.Now()
+
+	var healthy []*zone
+	for _, z := range g.zones {
+		if z.healthy(now) {
+			healthy = append(healthy, z)
+		}
+	}
+	return healthy
+}
+
+func (g *multiZoneGroup) markUnhealthy(z *zone) {
+	cooldown := g.q.cfg.ZoneFailureCooldown
+	if cooldown <= 0 {
+		cooldown = DefaultZoneFailureCooldown
+	}
+
+	z.unhealthyUntil = time.Now().Add(cooldown)
+	g.q.logger.Warn("Zone is out of capacity, skipping it", "zone", z.zone, "until", z.unhealthyUntil)
+}
+
+// plan decides how many of count launches go to each of the given zones.
+func (g *multiZoneGroup) plan(ctx context.Context, zones []*zone, count int64) (map[*zone]int64, error) {
+	plan := make(map[*zone]int64, len(zones))
+
+	if g.q.cfg.Placement == PlacementLeastLoaded || g.q.cfg.Placement == PlacementWeighted {
+		live := make(map[*zone]int64, len(zones))
+		for _, z := range zones {
+			instances, err := z.Instances(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", z.zone, err)
+			}
+			live[z] = newCapacity(instances).Live()
+		}
+
+		for i := int64(0); i < count; i++ {
+			var best *zone
+			for _, z := range zones {
+				if best == nil || g.lessLoaded(z, best, live[z]+plan[z], live[best]+plan[best]) {
+					best = z
+				}
+			}
+			plan[best]++
+		}
+
+		return plan, nil
+	}
+
+	for i := int64(0); i < count; i++ {
+		plan[zones[g.next%len(zones)]]++
+		g.next++
+	}
+
+	return plan, nil
+}
+
+// lessLoaded reports whether zone a, with aCount instances, should receive
+// the next launch ahead of zone b, with bCount instances.
+func (g *multiZoneGroup) lessLoaded(a, b *zone, aCount, bCount int64) bool {
+	if g.q.cfg.Placement == PlacementWeighted {
+		// Compare aCount/a.weight with bCount/b.weight without dividing.
+		return aCount*b.weight < bCount*a.weight
+	}
+	return aCount < bCount
+}
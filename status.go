@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/endocrimes/buildkite-gcp-scaler/scaler"
+)
+
+// printStatus writes a table per queue: a summary of its jobs, capacity and
+// the current decision, followed by its instances.
+func printStatus(out io.Writer, statuses []*scaler.QueueStatus) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for i, qs := range statuses {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+
+		d := qs.Decision
+		fmt.Fprintf(w, "Queue:\t%s\n", qs.Queue)
+		fmt.Fprintf(w, "Jobs:\t%d scheduled, %d running, %d waiting\n", qs.ScheduledJobs, qs.RunningJobs, qs.WaitingJobs)
+		fmt.Fprintf(w, "Agents:\t%d idle, %d busy, %d external\n", qs.IdleAgents, qs.BusyAgents, d.ExternalAgents)
+		fmt.Fprintf(w, "Instances:\t%d pending, %d available, %d draining\n", qs.Pending, qs.Available, qs.Draining)
+		fmt.Fprintf(w, "Decision:\t%s\n", describeDecision(d))
+
+		if len(qs.Instances) == 0 {
+			continue
+		}
+
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "INSTANCE\tZONE\tSTATUS\tAGE\tSTATE\tAGENT")
+		for _, st := range qs.Instances {
+			age := "-"
+			if a := st.Instance.Age(); a > 0 {
+				age = a.Round(time.Second).String()
+			}
+
+			agent := "-"
+			if len(st.Agents) > 0 {
+				names := make([]string, 0, len(st.Agents))
+				for _, a := range st.Agents {
+					names = append(names, a.Name)
+				}
+				agent = strings.Join(names, ",")
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", st.Instance.Name, st.Instance.Zone, st.Instance.Status, age, st.State, agent)
+		}
+	}
+
+	return w.Flush()
+}
+
+func describeDecision(d *scaler.Decision) string {
+	switch d.Action {
+	case scaler.DecisionLaunch:
+		return fmt.Sprintf("launch %d for %s (desired %d, live %d)", d.Count, d.LaunchReason, d.Desired, d.Live)
+	case scaler.DecisionScaleIn:
+		return fmt.Sprintf("scale in up to %d idle (desired %d, live %d)", d.Count, d.Desired, d.Live)
+	}
+
+	if d.Reason != "" {
+		return fmt.Sprintf("none, %s (desired %d, live %d)", d.Reason, d.Desired, d.Live)
+	}
+	return fmt.Sprintf("none (desired %d, live %d)", d.Desired, d.Live)
+}